@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+)
+
+// An archive bundles several named filters, say one for each day, into a single file. It starts with a directory
+// saying where each filter is, followed by the filters themselves in the usual binary format (see encoding.go):
+//
+//	4 bytes  magic number "BLMA"
+//	1 byte   archive format version, currently 1
+//	varint   number of filters
+//
+// then for each filter:
+//
+//	varint   length of its name, then the name itself
+//	varint   where its data starts, counting from the end of the directory
+//	varint   how many bytes of data it has
+//
+// and then the data. The directory comes first so that a reader can find any one filter without having to decode
+// all the others. The filters' data follows in the same order as the directory, one straight after the other, with
+// no gaps or overlaps. The varints are the ones from encoding/binary
+var archiveMagic = []byte("BLMA")
+
+const archiveVersion = 1
+
+// Names are for people to read, so there's no need for them to be long. Capping them stops a corrupt directory from
+// making us allocate a huge name
+const maxArchiveName = 1 << 16
+
+type archiveEntry struct {
+	name   string
+	offset uint64
+	length uint64
+}
+
+// Write every filter in filters to w as one archive. The filters go in in order of name, so the same filters always
+// make exactly the same bytes
+func WriteArchive(w io.Writer, filters map[string]*BloomFilter) error {
+	names := make([]string, 0, len(filters))
+	for name := range filters {
+		if len(name) > maxArchiveName {
+			return fmt.Errorf("bloom: filter name is %d bytes long, more than the limit of %d", len(name), maxArchiveName)
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var data [][]byte
+	directory := binary.AppendUvarint(append(bytes.Clone(archiveMagic), archiveVersion), uint64(len(names)))
+	offset := 0
+	for _, name := range names {
+		filter := filters[name]
+		if filter == nil {
+			return fmt.Errorf("bloom: filter %q is nil", name)
+		}
+		encoded, err := filter.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("archive filter %q: %w", name, err)
+		}
+		data = append(data, encoded)
+		directory = binary.AppendUvarint(directory, uint64(len(name)))
+		directory = append(directory, name...)
+		directory = binary.AppendUvarint(directory, uint64(offset))
+		directory = binary.AppendUvarint(directory, uint64(len(encoded)))
+		offset += len(encoded)
+	}
+
+	out := bufio.NewWriter(w)
+	if _, err := out.Write(directory); err != nil {
+		return err
+	}
+	for _, encoded := range data {
+		if _, err := out.Write(encoded); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// Read an archive written by WriteArchive. Like ReadFrom, this stops at the end of the archive and leaves anything
+// after it in r unread. Every filter is checked just as UnmarshalBinary would check it, and if any of them is
+// broken, or the directory is, the whole archive is rejected. The filters come back with DefaultHasher, so an archive
+// holding a filter saved with any other hasher is rejected too (see UnmarshalBinary)
+func ReadArchive(r io.Reader) (map[string]*BloomFilter, error) {
+	// The directory is full of varints, and reading them a byte at a time makes sure we don't read past its end
+	br := &countingByteReader{r: r, n: new(int64)}
+	magic := make([]byte, len(archiveMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, errors.New("bloom: too short to be a filter archive")
+	}
+	if !bytes.Equal(magic, archiveMagic) {
+		return nil, fmt.Errorf("bloom: not a filter archive (bad magic number %q)", magic)
+	}
+	version, err := br.ReadByte()
+	if err != nil {
+		return nil, archiveError(err)
+	}
+	if version != archiveVersion {
+		return nil, fmt.Errorf("bloom: unsupported archive version %d", version)
+	}
+
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, archiveError(err)
+	}
+	var entries []archiveEntry
+	seen := make(map[string]bool)
+	var dataLen uint64
+	for range count {
+		nameLen, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, archiveError(err)
+		}
+		if nameLen > maxArchiveName {
+			return nil, fmt.Errorf("bloom: archive has a filter name %d bytes long, more than the limit of %d", nameLen, maxArchiveName)
+		}
+		name := make([]byte, nameLen)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, archiveError(err)
+		}
+		if seen[string(name)] {
+			return nil, fmt.Errorf("bloom: archive has more than one filter called %q", name)
+		}
+		seen[string(name)] = true
+		entry := archiveEntry{name: string(name)}
+		if entry.offset, err = binary.ReadUvarint(br); err != nil {
+			return nil, archiveError(err)
+		}
+		if entry.length, err = binary.ReadUvarint(br); err != nil {
+			return nil, archiveError(err)
+		}
+		// Each filter has to start where the one before it ended. Overlapping entries would let a small archive
+		// decode the same data over and over, and a filter can make us allocate up to 64 times its length (see
+		// maxSparseRatio), so this keeps the memory we use in proportion to the size of the archive
+		if entry.offset != dataLen {
+			return nil, fmt.Errorf("bloom: filter %q starts at %d, but the one before it ends at %d", entry.name, entry.offset, dataLen)
+		}
+		// The data has to fit in memory, so its end has to fit in an int. Checking that here also means adding the
+		// offset and length together can't overflow
+		if entry.length > math.MaxInt-entry.offset {
+			return nil, fmt.Errorf("bloom: filter %q is past the end of any possible archive", entry.name)
+		}
+		dataLen = entry.offset + entry.length
+		entries = append(entries, entry)
+	}
+
+	// The directory can claim any amount of data, so rather than allocating it all up front, let ReadAll grow the
+	// buffer as the data actually arrives
+	data, err := io.ReadAll(io.LimitReader(r, int64(dataLen)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) < dataLen {
+		return nil, errors.New("bloom: archive is truncated")
+	}
+	filters := make(map[string]*BloomFilter, len(entries))
+	for _, entry := range entries {
+		filter := &BloomFilter{}
+		if err := filter.UnmarshalBinary(data[entry.offset : entry.offset+entry.length]); err != nil {
+			return nil, fmt.Errorf("archive filter %q: %w", entry.name, err)
+		}
+		filters[entry.name] = filter
+	}
+	return filters, nil
+}
+
+// Running out of data partway through the directory means the archive was cut short
+func archiveError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errors.New("bloom: archive is truncated")
+	}
+	return err
+}
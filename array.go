@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// More things you can do with an ArrayWithBloomFilter. The type itself lives in main.go
+
+// The bloom filter can't forget a value, but the array can. To remove a value we take it out of the array
+// and then build a brand new filter from whatever is left, which is slow for a big array but always correct
+// If the value was added more than once, only the first copy is removed
+// Returns whether the value was there to remove
+func (a *ArrayWithBloomFilter[T]) Remove(value T) bool {
+	for i, el := range a.array {
+		if el == value {
+			a.array = append(a.array[:i], a.array[i+1:]...)
+			a.unindex(value)
+			a.rebuild(a.filter.size, a.filter.k)
+			return true
+		}
+	}
+	return false
+}
+
+// Throw away the bloom filter and make a new one of the given size and k from the values in the array
+// The new filter keeps the old one's hasher, namespace, seed and normalizer
+func (a *ArrayWithBloomFilter[T]) rebuild(size, k int) {
+	if k == 0 {
+		// The old filter was never used, so it doesn't have a k yet
+		k = defaultK
+	}
+	filter := NewBloomFilterWithHasher(size, k, a.filter.hasher)
+	filter.namespace = a.filter.namespace
+	filter.seed = a.filter.seed
+	filter.normalize = a.filter.normalize
+	for _, el := range a.array {
+		filter.Set(a.toBytes(el))
+	}
+	a.filter = filter
+	a.setBits = filter.PopCount()
+}
+
+// Is the bloom filter actually saving us any work? These counters keep track of what happened on every Test
+type ArrayStats struct {
+	FilterRejects  int // The filter ruled the value out, so we didn't need to look at the array at all
+	LinearScans    int // The filter couldn't rule the value out, so we had to scan the array
+	FalsePositives int // We scanned the array and the value wasn't there after all. This scan was wasted work
+}
+
+// If FilterRejects is high compared to LinearScans, the filter is earning its keep. If most of the LinearScans
+// are FalsePositives, the filter is too small (or too full) for the array and should be rebuilt bigger
+func (a *ArrayWithBloomFilter[T]) Stats() ArrayStats {
+	return a.stats
+}
+
+// Merging moves everything from other into a as well (other itself is left alone). The arrays are simply
+// joined end to end, so a value that's in both shows up twice afterwards, just as if you'd called Set twice.
+// If the filters are the same size, they're combined with Union, which also needs them to have the same k and
+// hasher. Auto-resizing means two arrays holding different numbers of values usually end up with different sizes,
+// though, and then Union can't help. But the array has every value in it, so we just rebuild a's filter from all
+// of them, at whichever of the two sizes is bigger
+// Both arrays need to turn values into bytes the same way, or the merged filter will give wrong answers
+func (a *ArrayWithBloomFilter[T]) Merge(other *ArrayWithBloomFilter[T]) error {
+	size, otherSize := a.filter.Size(), other.filter.Size()
+	var union *BloomFilter
+	if size == otherSize {
+		var err error
+		if union, err = a.filter.Union(other.filter); err != nil {
+			return err
+		}
+	}
+	a.array = append(a.array, other.array...)
+	if a.index != nil {
+		for _, el := range other.array {
+			a.index[el]++
+		}
+	}
+	if union != nil {
+		a.filter = union
+		a.setBits = union.PopCount()
+	} else {
+		a.rebuild(max(size, otherSize), a.filter.k)
+	}
+	a.resizeIfSaturated()
+	return nil
+}
+
+// Load newline-separated strings from r into a, skipping blank lines, and return how many were added.
+// This is handy for things like loading a dictionary for a spell checker
+// It's a function rather than a method because it only makes sense for an array of strings, and Go doesn't
+// let you write a method for just one kind of ArrayWithBloomFilter
+func LoadFromReader(a *ArrayWithBloomFilter[string], r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	loaded := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		a.Set(line)
+		loaded++
+	}
+	return loaded, scanner.Err()
+}
+
+// A bloom filter can't be resized on its own, because it doesn't remember the elements that went into it.
+// But the array does, so we can build a new filter of any size from scratch. Growing the filter when it's
+// getting saturated brings the false-positive rate (and the number of wasted scans) back down
+func (a *ArrayWithBloomFilter[T]) Resize(newSize int) {
+	a.rebuild(newSize, a.filter.k)
+}
+
+// Set always appends, so calling it twice with the same value stores the value twice, which wastes memory and
+// makes every scan longer. SetUnique only appends the value if it isn't already in the array. The bloom filter
+// makes this cheap for new values: if the filter rules the value out, we can append it straight away without
+// scanning. We only scan when the filter says the value might be there already
+func (a *ArrayWithBloomFilter[T]) SetUnique(value T) {
+	a.AddIfAbsent(value)
+}
+
+// The same as SetUnique, but tells you whether the value was new. A positive from the filter is always checked
+// against the array, so a new value that happens to be a false positive is still added, and still reported as new
+func (a *ArrayWithBloomFilter[T]) AddIfAbsent(value T) bool {
+	if a.filter.Test(a.toBytes(value)) && a.contains(value) {
+		return false
+	}
+	a.Set(value)
+	return true
+}
+
+// SetUniqueFast never scans the array: if the filter says the value is probably there already, we take its word
+// for it. That's much faster for a big array, but it means a genuinely new value that happens to be a false
+// positive gets silently dropped. Only use this if losing the occasional value is acceptable
+func (a *ArrayWithBloomFilter[T]) SetUniqueFast(value T) {
+	if a.filter.Test(a.toBytes(value)) {
+		return
+	}
+	a.Set(value)
+}
+
+// The slow, certain check: look at every value in the array. With an index it's not slow any more
+func (a *ArrayWithBloomFilter[T]) contains(value T) bool {
+	if a.index != nil {
+		return a.index[value] > 0
+	}
+	for _, el := range a.array {
+		if el == value {
+			return true
+		}
+	}
+	return false
+}
+
+// A fixed-size filter slowly fills up as the array grows, and once it's saturated it says "maybe" to everything
+// and every Test ends up scanning the array anyway. So by default, whenever the filter gets to half full,
+// we rebuild it at twice the size. That's a full pass over the array, but it happens less and less often as the
+// array grows, just like a Go slice doubling its capacity
+const defaultResizeThreshold = 0.5
+
+func (a *ArrayWithBloomFilter[T]) resizeIfSaturated() {
+	if a.noAutoResize {
+		return
+	}
+	threshold := a.resizeThreshold
+	if threshold == 0 {
+		threshold = defaultResizeThreshold
+	}
+	for float64(a.setBits)/float64(a.filter.size) >= threshold {
+		a.Resize(2 * a.filter.size)
+	}
+}
+
+// Change how saturated the filter can get before it's rebuilt at twice the size. Lower means fewer false positives
+// but more memory and more frequent rebuilds. The threshold must be above 0 and at most 1; 1 never resizes unless
+// every bit ends up set
+func (a *ArrayWithBloomFilter[T]) SetAutoResizeThreshold(threshold float64) {
+	if threshold <= 0 || threshold > 1 {
+		panic("bloom: resize threshold must be above 0 and at most 1")
+	}
+	a.resizeThreshold = threshold
+	a.noAutoResize = false
+	a.resizeIfSaturated()
+}
+
+// Keep the filter at its current size no matter how full it gets, for example because you'd rather call Resize
+// yourself at a time that suits you
+func (a *ArrayWithBloomFilter[T]) DisableAutoResize() {
+	a.noAutoResize = true
+}
+
+// Call fn with every value in the array, in the order they were added, until fn returns false. This lets you look
+// through the values (say, to print the ones matching something) without getting hold of the array itself, which
+// would let you change it behind the filter's back. Don't add or remove values from inside fn
+func (a *ArrayWithBloomFilter[T]) Each(fn func(value T) bool) {
+	for _, el := range a.array {
+		if !fn(el) {
+			return
+		}
+	}
+}
+
+// Whenever the filter can't rule a value out, we have to check the array, and scanning a big array is slow: a million
+// values means a million comparisons for every false positive. EnableIndex keeps a map of the values alongside the
+// array, so that check becomes a single map lookup. The filter still goes first, since asking it is cheaper than
+// hashing the value for the map, and it answers most questions about values that aren't there on its own
+// A map costs far more memory per value than the array does, which is why it's not the default. The Stats still
+// count a map lookup as one of the LinearScans, since it's the same check done faster. Returns the array so you can
+// write NewArrayWithBloomFilter().EnableIndex()
+func (a *ArrayWithBloomFilter[T]) EnableIndex() *ArrayWithBloomFilter[T] {
+	if a.index == nil {
+		a.index = make(map[T]int, len(a.array))
+		for _, el := range a.array {
+			a.index[el]++
+		}
+	}
+	return a
+}
+
+// One copy of value has gone from the array, so take one off its count in the index
+func (a *ArrayWithBloomFilter[T]) unindex(value T) {
+	if a.index == nil {
+		return
+	}
+	a.index[value]--
+	if a.index[value] == 0 {
+		delete(a.index, value)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// CountingBloomFilter isn't safe to use from several goroutines at once, and wrapping it in a lock would make every
+// goroutine wait its turn, even when they're touching completely different counters. AtomicCountingBloomFilter
+// does without a lock: each counter is a uint32 that's only ever changed with sync/atomic instructions, so any
+// number of goroutines can Set, Unset and Test at the same time
+//
+// The catch is that each counter is changed on its own. A Test that runs while another goroutine is halfway through
+// setting the same element might see some of its counters bumped and some not yet, and say it's not present. Once
+// the Set has returned, every Test sees it
+//
+// The counters are also much bigger than CountingBloomFilter's: 4 bytes each instead of 1, so 32 times the size of
+// a BloomFilter with the same number of positions. In return they take a lot longer to saturate (see maxAtomicCount)
+type AtomicCountingBloomFilter struct {
+	counts []uint32
+	k      int
+	once   sync.Once // The zero value is set up the first time it's used, and this makes that safe from any goroutine
+}
+
+// Like maxCount, a counter that gets this high is stuck there. With 32-bit counters that takes over 4 billion Sets
+// landing on one position, so in practice it only happens to a filter that's far too small
+const maxAtomicCount = math.MaxUint32
+
+func NewAtomicCountingBloomFilter(size, k int) *AtomicCountingBloomFilter {
+	if size < 1 {
+		panic("bloom: size must be at least 1")
+	}
+	if k < 1 {
+		panic("bloom: k must be at least 1")
+	}
+	c := &AtomicCountingBloomFilter{counts: make([]uint32, size), k: k}
+	c.once.Do(func() {}) // Already set up, so init must leave these counters alone
+	return c
+}
+
+func (c *AtomicCountingBloomFilter) init() {
+	c.once.Do(func() {
+		c.counts = make([]uint32, defaultSize)
+		c.k = defaultK
+	})
+}
+
+func (c *AtomicCountingBloomFilter) getPositions(data []byte) []int {
+	return hashPositions(DefaultHasher{}, data, len(c.counts), c.k)
+}
+
+// atomic.AddUint32 would be simpler, but it can't stop at a limit: it would happily wrap a stuck counter back round
+// to 0, or take 0 down to the maximum. So we load the counter, work out the new value, and only store it if nobody
+// else changed the counter in the meantime. If someone did, we load it again and have another go
+func (c *AtomicCountingBloomFilter) update(pos int, next func(count uint32) (uint32, bool)) {
+	for {
+		count := atomic.LoadUint32(&c.counts[pos])
+		updated, ok := next(count)
+		if !ok || atomic.CompareAndSwapUint32(&c.counts[pos], count, updated) {
+			return
+		}
+	}
+}
+
+// Adding an element bumps the counter at each of its positions, unless it's stuck at maxAtomicCount
+func (c *AtomicCountingBloomFilter) Set(data []byte) *AtomicCountingBloomFilter {
+	c.init()
+	for _, pos := range c.getPositions(data) {
+		c.update(pos, func(count uint32) (uint32, bool) {
+			return count + 1, count < maxAtomicCount
+		})
+	}
+	return c
+}
+
+// Removing an element decrements each of its counters, with the same rules as CountingBloomFilter.Unset: only remove
+// elements you actually added, elements that definitely aren't present are left alone, and counters never go below 0
+// or move once they're stuck at maxAtomicCount
+func (c *AtomicCountingBloomFilter) Unset(data []byte) *AtomicCountingBloomFilter {
+	if !c.Test(data) {
+		return c
+	}
+	for _, pos := range c.getPositions(data) {
+		c.update(pos, func(count uint32) (uint32, bool) {
+			return count - 1, count > 0 && count < maxAtomicCount
+		})
+	}
+	return c
+}
+
+func (c *AtomicCountingBloomFilter) Test(data []byte) bool {
+	c.init()
+	for _, pos := range c.getPositions(data) {
+		if atomic.LoadUint32(&c.counts[pos]) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// The smallest of the element's counters, just like CountingBloomFilter.Frequency
+func (c *AtomicCountingBloomFilter) Frequency(data []byte) uint32 {
+	c.init()
+	lowest := uint32(maxAtomicCount)
+	for _, pos := range c.getPositions(data) {
+		lowest = min(lowest, atomic.LoadUint32(&c.counts[pos]))
+	}
+	return lowest
+}
+
+// Roughly how much memory the filter takes up, in bytes: 4 for every counter
+func (c *AtomicCountingBloomFilter) MemoryBytes() int {
+	return 4 * len(c.counts)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+)
+
+// Adding a big batch of elements one Set at a time works fine, but this saves a little work per element
+// (and, for a filter made with NewSyncBloomFilter, takes the lock once for the whole batch)
+// Like Set, it returns the filter so you can chain calls
+func (f *BloomFilter) SetAll(items [][]byte) *BloomFilter {
+	f.lock()
+	defer f.unlock()
+	for _, item := range items {
+		f.set(item)
+	}
+	return f
+}
+
+// Test a whole batch of elements. The answer for items[i] is in position i of the result
+func (f *BloomFilter) TestEach(items [][]byte) []bool {
+	f.rlock()
+	defer f.runlock()
+	results := make([]bool, len(items))
+	for i, item := range items {
+		results[i] = f.test(item)
+	}
+	return results
+}
+
+// Is any of these elements probably present? As soon as one tests positive we can stop looking
+// If items is empty there's nothing that could be present, so the answer is false
+func (f *BloomFilter) TestAny(items [][]byte) bool {
+	f.rlock()
+	defer f.runlock()
+	for _, item := range items {
+		if f.test(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// Are all of these elements probably present? As soon as one is definitely not present we can stop looking
+// If items is empty there's nothing missing, so the answer is true
+func (f *BloomFilter) TestAll(items [][]byte) bool {
+	f.rlock()
+	defer f.runlock()
+	for _, item := range items {
+		if !f.test(item) {
+			return false
+		}
+	}
+	return true
+}
+
+// This is what bloom filters are most often for: you have a long list of candidates and an expensive way to check
+// each one (a database query, a disk read, a network call), and most of them won't be there. Filter hands back just
+// the candidates that are probably present, in their original order, so you only pay for checking those. The
+// ones it drops are certainly not there. The ones it keeps still need checking, since some are false positives
+// The result shares its elements with candidates rather than copying them
+func (f *BloomFilter) Filter(candidates [][]byte) [][]byte {
+	f.rlock()
+	defer f.runlock()
+	var kept [][]byte
+	for _, candidate := range candidates {
+		if f.test(candidate) {
+			kept = append(kept, candidate)
+		}
+	}
+	return kept
+}
+
+// Loading millions of elements can take a while, and sometimes you need to give up partway, say because the
+// program is shutting down. SetAllContext is SetAll with a way to stop: it checks ctx every so often, and
+// once ctx is done it stops and returns ctx.Err() along with how many elements it had already added.
+// Those elements stay in the filter, since there's no way to take them back out
+func (f *BloomFilter) SetAllContext(ctx context.Context, items [][]byte) (int, error) {
+	added := 0
+	for added < len(items) {
+		if err := ctx.Err(); err != nil {
+			return added, err
+		}
+		// Checking ctx for every element would slow things down, so we add a chunk at a time in between checks.
+		// This also means a filter made with NewSyncBloomFilter lets readers in between chunks
+		end := min(added+contextChunk, len(items))
+		f.lock()
+		for _, item := range items[added:end] {
+			f.set(item)
+		}
+		f.unlock()
+		added = end
+	}
+	return added, nil
+}
+
+// How many elements SetAllContext adds between checks of its context
+const contextChunk = 1024
+
+// Add every token a bufio.Scanner produces, and return how many there were. The scanner decides what a token is, so
+// the same method handles one key per line (the default), words (bufio.ScanWords), or anything else you can write
+// a split function for, like keys separated by zero bytes. That's all set up on the scanner before you pass it in
+// The error is the scanner's own, if reading failed partway. Everything added before that stays in the filter
+//
+// Each token is added with Set, so a filter made with NewSyncBloomFilter only holds the lock for one token at a
+// time, and not while the scanner is waiting for more input
+func (f *BloomFilter) ConsumeScanner(s *bufio.Scanner) (int, error) {
+	added := 0
+	for s.Scan() {
+		f.Set(s.Bytes())
+		added++
+	}
+	return added, s.Err()
+}
+
+// Fill the filter with made-up keys until at least the given fraction of its bits are set, and return how many keys
+// that took. This is for testing code that uses a filter: an empty filter never gives false positives, so it won't
+// show you how your code copes with them, while a filter filled to, say, 0.5 behaves like one that's been in use for
+// a while. The keys are random, but the same seed always gives the same keys, so the same filter comes out every time
+// saturation has to be at least 0 and less than 1, since a filter can take a very long time to fill up completely
+//
+// A hasher that can't reach every position (see ObservedPositionRange) might never get there: LegacyHasher only
+// adds up the bytes of a key, so it never gets past the first thousand or so positions. So if fillPatience times
+// the size keys in a row don't set a single new bit, we give up and return an error along with the keys we added
+func (f *BloomFilter) FillTo(saturation float64, seed uint64) (int, error) {
+	if saturation < 0 || saturation >= 1 {
+		panic("bloom: saturation must be at least 0 and less than 1")
+	}
+	f.lock()
+	defer f.unlock()
+	f.init()
+	rng := rand.New(rand.NewPCG(seed, 0))
+	set := f.popCount()
+	added := 0
+	misses := 0
+	key := make([]byte, 8)
+	for float64(set) < saturation*float64(f.size) {
+		if misses >= fillPatience*f.size {
+			return added, fmt.Errorf("bloom: gave up filling at saturation %.3f of %.3f, since new keys stopped setting any bits", float64(set)/float64(f.size), saturation)
+		}
+		binary.BigEndian.PutUint64(key, rng.Uint64())
+		changed := f.set(key)
+		set += changed
+		added++
+		if changed == 0 {
+			misses++
+		} else {
+			misses = 0
+		}
+	}
+	return added, nil
+}
+
+// With a hasher that reaches every position, while any bit is still 0 each key has about a k/size chance of setting
+// it, so going this many times the size without a new bit happens less than once in a billion times by chance
+const fillPatience = 20
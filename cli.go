@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Run with no arguments, this program just shows off ArrayWithBloomFilter. Given a subcommand, it works as a
+// little tool that keeps a bloom filter in a file:
+//
+//	bloom -file words.bloom -size 10000 add apple banana cherry
+//	bloom -file words.bloom test banana
+//	bloom -n 50000 -fpr 0.001 build < words.txt > words.bloom
+//
+// add creates the file if it doesn't exist yet, and otherwise adds to the filter that's already there
+// (in which case -size is ignored, since the filter already has one)
+// build reads one key per line from stdin instead, and writes the filter file to stdout, so it can go in the middle
+// of a shell pipeline. The filter is sized for -n keys at a false-positive rate of -fpr
+func runCLI(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("bloom", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	path := flags.String("file", "filter.bloom", "file the filter is saved in")
+	size := flags.Int("size", 1000, "number of bits in a new filter")
+	expected := flags.Int("n", 1000, "number of keys build should size the filter for")
+	fpr := flags.Float64("fpr", 0.01, "false-positive rate build should size the filter for")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: bloom [flags] add <word>...")
+		fmt.Fprintln(stderr, "       bloom [flags] test <word>")
+		fmt.Fprintln(stderr, "       bloom [flags] build < keys > file")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	switch flags.Arg(0) {
+	case "add":
+		return cliAdd(*path, *size, flags.Args()[1:], stdout)
+	case "test":
+		if flags.NArg() != 2 {
+			flags.Usage()
+			return errors.New("test takes exactly one word")
+		}
+		return cliTest(*path, flags.Arg(1), stdout)
+	case "build":
+		return cliBuild(*expected, *fpr, stdin, stdout, stderr)
+	case "":
+		flags.Usage()
+		return errors.New("missing command")
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown command %q", flags.Arg(0))
+	}
+}
+
+func cliAdd(path string, size int, words []string, stdout io.Writer) error {
+	if len(words) == 0 {
+		return errors.New("add needs at least one word")
+	}
+	if size < 1 {
+		return errors.New("size must be at least 1")
+	}
+	filter, err := LoadFromFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		filter, err = NewBloomFilter(WithSize(size)), nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, word := range words {
+		filter.Set([]byte(word))
+	}
+	if err := filter.SaveToFile(path); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "added %d words to %s\n", len(words), path)
+	return nil
+}
+
+func cliTest(path, word string, stdout io.Writer) error {
+	filter, err := LoadFromFile(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s: %s\n", word, filter.Classify([]byte(word)))
+	return nil
+}
+
+func cliBuild(expected int, fpr float64, stdin io.Reader, stdout, stderr io.Writer) error {
+	if expected < 1 {
+		return errors.New("n must be at least 1")
+	}
+	if fpr <= 0 || fpr >= 1 {
+		return errors.New("fpr must be between 0 and 1")
+	}
+	filter := NewBloomFilterFor(expected, fpr)
+	scanner := bufio.NewScanner(stdin)
+	for scanner.Scan() {
+		if line := scanner.Bytes(); len(bytes.TrimSpace(line)) > 0 {
+			filter.Set(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	// Going past the expected count still works, but the filter gets fuller than it was sized for, and its
+	// false-positive rate goes up with it. The filter itself is fine, so this is only a warning
+	if added := filter.InsertCount(); added > expected {
+		fmt.Fprintf(stderr, "warning: read %d keys but the filter was sized for %d, so expect a false-positive rate of about %.2g rather than %g\n",
+			added, expected, filter.FalsePositiveRate(added), fpr)
+	}
+
+	// The same bytes SaveToFile would write, so the output can be used with -file
+	w := bufio.NewWriter(stdout)
+	if _, err := w.Write(fileMagic); err != nil {
+		return err
+	}
+	if _, err := filter.WriteTo(w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
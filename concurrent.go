@@ -0,0 +1,42 @@
+package main
+
+// A plain BloomFilter isn't safe to use from several goroutines at once: two goroutines setting bits in the
+// same word can overwrite each other's changes. Most programs only touch a filter from one goroutine, so we
+// don't want to pay for a lock on every call. Instead, filters made with NewSyncBloomFilter (or the
+// WithConcurrency option) carry a sync.RWMutex. Set and Reset take the write lock, and Test takes the read
+// lock, so any number of goroutines can test at the same time while writes happen one at a time
+//
+// The methods that add, test or clear elements (Set, Test, Reset and their batch versions) are protected, and so
+// are the ones that only look at a single filter: PopCount and everything in stats.go built on it, InsertCount,
+// Bits, Validate and the instrumentation reports. That's what makes a Frozen view of a filter that's still being
+// built safe to use. Size and K never change once a filter is made, so they don't need the lock
+// Methods that combine filters or convert them to and from other forms (Union, MarshalBinary and so on) still need
+// the caller to make sure nothing is writing to the filter while they run
+func NewSyncBloomFilter(size, k int) *BloomFilter {
+	return NewBloomFilter(WithSize(size), WithK(k), WithConcurrency())
+}
+
+// These do nothing for an ordinary filter, so the lock-free path costs only a nil check
+func (f *BloomFilter) lock() {
+	if f.mu != nil {
+		f.mu.Lock()
+	}
+}
+
+func (f *BloomFilter) unlock() {
+	if f.mu != nil {
+		f.mu.Unlock()
+	}
+}
+
+func (f *BloomFilter) rlock() {
+	if f.mu != nil {
+		f.mu.RLock()
+	}
+}
+
+func (f *BloomFilter) runlock() {
+	if f.mu != nil {
+		f.mu.RUnlock()
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import "fmt"
+
+// A normal bloom filter can't forget anything: once a bit is set we have no idea how many elements set it,
+// so clearing it might wipe out some other element too. A counting bloom filter fixes this by keeping a
+// small counter at each position instead of a single bit. Adding an element increments its counters and
+// removing it decrements them, so a position only drops back to 0 once every element using it has gone
+type CountingBloomFilter struct {
+	counts []uint8 // Every counter starts at 0, just like the bits in a normal filter
+	k      int
+}
+
+// A counter that reaches this value is stuck there for good. We've lost track of how many elements really
+// use that position, so decrementing it could make it hit 0 too early and give us a false negative
+const maxCount = 255
+
+func NewCountingBloomFilter(size, k int) *CountingBloomFilter {
+	if size < 1 {
+		panic("bloom: size must be at least 1")
+	}
+	if k < 1 {
+		panic("bloom: k must be at least 1")
+	}
+	return &CountingBloomFilter{counts: make([]uint8, size), k: k}
+}
+
+// Like BloomFilter, the zero value gets the default size and k the first time it's used
+func (c *CountingBloomFilter) init() {
+	if c.counts == nil {
+		c.counts = make([]uint8, defaultSize)
+	}
+	if c.k == 0 {
+		c.k = defaultK
+	}
+}
+
+func (c *CountingBloomFilter) getPositions(data []byte) []int {
+	return hashPositions(DefaultHasher{}, data, len(c.counts), c.k)
+}
+
+// Adding an element bumps the counter at each of its positions. A counter that has already hit 255
+// stays at 255 instead of wrapping around to 0
+func (c *CountingBloomFilter) Set(data []byte) *CountingBloomFilter {
+	c.init()
+	for _, pos := range c.getPositions(data) {
+		if c.counts[pos] < maxCount {
+			c.counts[pos]++
+		}
+	}
+	return c
+}
+
+// Removing an element decrements each of its counters. Only remove elements you actually added: if the
+// element was never added but happens to test positive, removing it will eat into counters that belong
+// to other elements and can cause false negatives. If it definitely isn't present, we do nothing at all
+// Counters never go below 0, and counters stuck at 255 are left alone (see maxCount)
+func (c *CountingBloomFilter) Unset(data []byte) *CountingBloomFilter {
+	if !c.Test(data) {
+		return c
+	}
+	for _, pos := range c.getPositions(data) {
+		if c.counts[pos] > 0 && c.counts[pos] < maxCount {
+			c.counts[pos]--
+		}
+	}
+	return c
+}
+
+// Testing works exactly like a normal bloom filter, except "bit is set" means "counter is above 0"
+func (c *CountingBloomFilter) Test(data []byte) bool {
+	if c.counts == nil {
+		return false
+	}
+	for _, pos := range c.getPositions(data) {
+		if c.counts[pos] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Because each counter goes up by one every time an element using it is added, the counters also tell us
+// roughly how many times an element went in. Other elements can only ever add to a counter, never take away,
+// so the smallest counter across the element's positions is the closest we can get to its true count.
+// This is the same trick a count-min sketch uses
+//
+// The answer is never less than the true count (unless something that was never added got Unset, or the
+// count is over 255), but it can be more, if every one of its counters is shared with some other element
+func (c *CountingBloomFilter) Frequency(data []byte) uint8 {
+	if c.counts == nil {
+		return 0
+	}
+	lowest := uint8(maxCount)
+	for _, pos := range c.getPositions(data) {
+		lowest = min(lowest, c.counts[pos])
+	}
+	return lowest
+}
+
+// Roughly how much memory the filter takes up, in bytes. Each counter is a whole byte, so a counting filter is 8
+// times the size of a BloomFilter with the same number of positions. That's the price of being able to Unset
+func (c *CountingBloomFilter) MemoryBytes() int {
+	return len(c.counts)
+}
+
+// Add every counter in other to the matching counter in c, as if every element added to other had been added to c
+// as well. This is how you combine counts kept on different machines. Sums that would go past 255 stop there, and
+// like any counter at 255 they're stuck (see maxCount)
+// Both filters need the same size and k, or their positions don't line up
+func (c *CountingBloomFilter) Add(other *CountingBloomFilter) error {
+	c.init()
+	other.init()
+	if len(c.counts) != len(other.counts) {
+		return fmt.Errorf("%w: different sizes (%d and %d)", ErrIncompatibleFilters, len(c.counts), len(other.counts))
+	}
+	if c.k != other.k {
+		return fmt.Errorf("%w: different k (%d and %d)", ErrIncompatibleFilters, c.k, other.k)
+	}
+	for i, count := range other.counts {
+		c.counts[i] = uint8(min(int(c.counts[i])+int(count), maxCount))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"io"
+)
+
+// A common job for a bloom filter: go through a huge log file and only keep the lines we haven't seen before.
+// Remembering every line exactly would take as much memory as the file itself, but a filter only needs a few bits
+// per line. DedupLines reads r a line at a time, writes each line to w the first time it turns up, and returns how
+// many lines it wrote. size and k are the same as for NewBloomFilterWithK (see NewBloomFilterFor and
+// OptimalParameters for how to pick them)
+//
+// The catch is false positives. If a line that's genuinely new happens to test positive, it looks like a duplicate
+// and gets dropped. With a well-sized filter that's rare, but it does happen, and the bigger the file is compared to
+// the filter the more often it happens. If you can't afford to lose any lines, use DedupLinesExact instead
+func DedupLines(r io.Reader, w io.Writer, size, k int) (int, error) {
+	filter := NewBloomFilterWithK(size, k)
+	return dedupLines(r, w, func(line string) bool {
+		// TestAndSet tells us whether the line was already there, and adds it if it wasn't, in one go
+		return !filter.TestAndSet([]byte(line))
+	})
+}
+
+// The same as DedupLines, but never drops a unique line. Every line is kept in an ArrayWithBloomFilter, so when the
+// filter says we've probably seen a line before, we can check to be sure. The array has an index (see EnableIndex),
+// so checking doesn't mean scanning every line so far. But this does need enough memory to hold every unique line,
+// and then some. It's a good fit when there are lots of duplicates and not too many distinct lines
+func DedupLinesExact(r io.Reader, w io.Writer, size, k int) (int, error) {
+	seen := NewArrayWithBloomFilter().EnableIndex()
+	seen.filter = NewBloomFilterWithK(size, k)
+	return dedupLines(r, w, seen.AddIfAbsent)
+}
+
+// The part both kinds of dedup share. isNew is called once for every line, and has to remember the line so that it
+// reports false the next time the same line comes along
+func dedupLines(r io.Reader, w io.Writer, isNew func(line string) bool) (int, error) {
+	scanner := bufio.NewScanner(r)
+	out := bufio.NewWriter(w)
+	written := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !isNew(line) {
+			continue
+		}
+		if _, err := out.WriteString(line + "\n"); err != nil {
+			return written, err
+		}
+		written++
+	}
+	if err := scanner.Err(); err != nil {
+		out.Flush()
+		return written, err
+	}
+	return written, out.Flush()
+}
@@ -0,0 +1,40 @@
+package main
+
+// A counting filter supports deletion but needs a whole byte per position. If that's too much memory, there's a
+// cheaper trick: keep a second, ordinary filter of "tombstones". Deleting an element adds it to the tombstone
+// filter, and an element only counts as present if it's in the first filter and not in the tombstone one
+//
+// The catch is that the tombstone filter has false positives too, and here a false positive does real damage.
+// If an element you never deleted happens to test positive among the tombstones, it will look deleted even though
+// it's really there. So unlike a normal bloom filter, this one can give false negatives. The more you delete, the
+// more likely that gets, so this only makes sense if deletions are rare
+//
+// Tombstones are permanent, which also means a deleted element can't come back: setting it again afterwards
+// does nothing, because it's still in the tombstone filter
+type DeletableBloomFilter struct {
+	added   BloomFilter
+	deleted BloomFilter
+}
+
+// Both filters get the same size and k
+func NewDeletableBloomFilter(size, k int) *DeletableBloomFilter {
+	return &DeletableBloomFilter{
+		added:   *NewBloomFilterWithK(size, k),
+		deleted: *NewBloomFilterWithK(size, k),
+	}
+}
+
+func (d *DeletableBloomFilter) Set(data []byte) *DeletableBloomFilter {
+	d.added.Set(data)
+	return d
+}
+
+func (d *DeletableBloomFilter) Delete(data []byte) *DeletableBloomFilter {
+	d.deleted.Set(data)
+	return d
+}
+
+// Probably present if it was probably added and it doesn't look deleted
+func (d *DeletableBloomFilter) Test(data []byte) bool {
+	return d.added.Test(data) && !d.deleted.Test(data)
+}
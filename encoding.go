@@ -0,0 +1,721 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"strings"
+)
+
+// Bloom filters are often built once and then used for a long time, so it's handy to be able to save one and
+// load it back later. The binary format is:
+//
+//	1 byte   format version, currently 4
+//	8 bytes  size (number of bits), big-endian
+//	8 bytes  k, big-endian
+//	8 bytes  number of Set calls (see InsertCount), big-endian
+//	1 byte   how the bits are stored: 0 for dense, 1 for sparse
+//	8 bytes  the ID of the hasher (see hasherID), big-endian
+//
+// followed by the bits. The dense form is every word of packed bits, 8 big-endian bytes each. That's wasteful for a
+// big filter with only a few bits set, which is mostly zeros, so for those we use the sparse form instead: how many
+// bits are set, then the gap in front of each set bit (how many 0 bits come before it since the last set bit), all as
+// varints (see encoding/binary). Small gaps take a single byte. We use whichever form comes out smaller (see
+// useSparse for the details)
+//
+// The version byte comes first so that when the format changes, old data can be recognised instead of misread.
+// Versions 1 to 3 can still be read. Version 3 didn't have the hasher ID, version 2 had no flag byte either and was
+// always dense, and version 1 didn't have the Set count either (it comes back with an InsertCount of 0)
+const binaryVersion = 4
+
+const binaryHeaderLen = 1 + 8 + 8 + 8 + 1 + 8
+
+// How long the header is for each version we know how to read
+var headerLens = map[byte]int{
+	1: 1 + 8 + 8,
+	2: 1 + 8 + 8 + 8,
+	3: 1 + 8 + 8 + 8 + 1,
+	4: binaryHeaderLen,
+}
+
+// The values of the flag byte
+const (
+	denseFlag  = 0
+	sparseFlag = 1
+)
+
+// Everything the header tells us about the filter that follows it
+type binaryHeader struct {
+	size    int
+	k       int
+	inserts int
+	sparse  bool
+	hasher  uint64 // The hasher's ID, or 0 if the data is too old to say
+	length  int    // How many bytes the header itself takes up, which depends on the version
+}
+
+// Every format stores the packed words the same way: 8 big-endian bytes per word, one after the other
+func putWords(data []byte, words []uint64) {
+	for i, word := range words {
+		binary.BigEndian.PutUint64(data[8*i:], word)
+	}
+}
+
+func getWords(data []byte) []uint64 {
+	words := make([]uint64, len(data)/8)
+	for i := range words {
+		words[i] = binary.BigEndian.Uint64(data[8*i:])
+	}
+	return words
+}
+
+func (f *BloomFilter) putHeader(data []byte, sparse bool) {
+	data[0] = binaryVersion
+	binary.BigEndian.PutUint64(data[1:], uint64(f.size))
+	binary.BigEndian.PutUint64(data[9:], uint64(f.k))
+	binary.BigEndian.PutUint64(data[17:], uint64(f.insertCount))
+	data[25] = denseFlag
+	if sparse {
+		data[25] = sparseFlag
+	}
+	binary.BigEndian.PutUint64(data[26:], f.hasherID())
+}
+
+// How many bytes a varint takes: one for every 7 bits of the number, and always at least one
+func uvarintLen(v uint64) int {
+	return (bits.Len64(v|1) + 6) / 7
+}
+
+// How many bytes the sparse form of the bits would take up. Working this out means going over every set bit, but
+// that's much cheaper than building the sparse form only to find it's too big
+func (f *BloomFilter) sparseLen() int {
+	n := uvarintLen(uint64(f.PopCount()))
+	prev := -1
+	f.EachSetBit(func(index int) {
+		n += uvarintLen(uint64(index - prev - 1))
+		prev = index
+	})
+	return n
+}
+
+// Whether the sparse form comes out smaller than the dense one. For a big filter that's roughly when fewer than
+// one bit in every 8 to 16 is set, depending on how far apart they are. It also has to be no more than
+// maxSparseRatio times smaller, or readSparse won't load it
+func (f *BloomFilter) useSparse() bool {
+	n := f.sparseLen()
+	return n < 8*len(f.bits) && 8*len(f.bits) <= maxSparseRatio*n
+}
+
+// A few bytes of sparse data could describe a filter of any size at all: a 35-byte header claiming a size of 2^50
+// would have us allocate 128TB, and running out of memory isn't something a program can recover from. So we only
+// load sparse data that's at most this many times smaller than the dense form would be. That way the memory we
+// allocate is never more than this many times what we've read. An empty filter still compresses 64 to 1, and a
+// filter emptier than that just gets written in the dense form instead
+const maxSparseRatio = 64
+
+func (f *BloomFilter) appendSparse(data []byte) []byte {
+	data = binary.AppendUvarint(data, uint64(f.PopCount()))
+	prev := -1
+	f.EachSetBit(func(index int) {
+		data = binary.AppendUvarint(data, uint64(index-prev-1))
+		prev = index
+	})
+	return data
+}
+
+// Go through the sparse form, calling fn with the position of every set bit, in increasing order. Like the header,
+// the gaps might have come from anywhere, so every one is checked to make sure it lands inside a filter of the
+// given size before fn sees it
+func eachSparseBit(r io.ByteReader, size int, fn func(pos int) error) error {
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	if count > uint64(size) {
+		return fmt.Errorf("bloom: sparse data has %d set bits, more than the size %d", count, size)
+	}
+	prev := -1
+	for range count {
+		gap, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		if gap >= uint64(size-prev-1) {
+			return fmt.Errorf("bloom: sparse data has a set bit past the end of a filter of size %d", size)
+		}
+		prev += int(gap) + 1
+		if err := fn(prev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Turn the sparse form back into packed words for a filter of the given size. We only know whether the data is long
+// enough for the size (see maxSparseRatio) once we've read all of it, so the positions are collected first, and the
+// words are only allocated after that check passes. The positions take up no more than 8 bytes for each byte read
+func readSparse(r io.ByteReader, size int) ([]uint64, error) {
+	counter := &byteCounter{r: r}
+	var positions []int
+	err := eachSparseBit(counter, size, func(pos int) error {
+		positions = append(positions, pos)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	words := wordsFor(size)
+	if 8*words > maxSparseRatio*counter.n {
+		return nil, fmt.Errorf("bloom: %d bytes of sparse data is too short for a filter of size %d", counter.n, size)
+	}
+	bits := make([]uint64, words)
+	for _, pos := range positions {
+		bits[pos/64] |= 1 << (pos % 64)
+	}
+	return bits, nil
+}
+
+// An io.ByteReader that counts how many bytes have been read through it
+type byteCounter struct {
+	r io.ByteReader
+	n int
+}
+
+func (c *byteCounter) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// Run read over sparse data that's all in memory already. All of data has to be used up
+func readSparseBytes(data []byte, read func(r io.ByteReader) error) error {
+	r := bytes.NewReader(data)
+	err := read(r)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errors.New("bloom: sparse bit data is truncated")
+	}
+	if err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("bloom: %d unexpected bytes after the sparse bit data", r.Len())
+	}
+	return nil
+}
+
+// readSparse for data that's all in memory already
+func getSparse(data []byte, size int) (words []uint64, err error) {
+	err = readSparseBytes(data, func(r io.ByteReader) error {
+		words, err = readSparse(r, size)
+		return err
+	})
+	return words, err
+}
+
+// Pull the bits out of the data that follows a header, in whichever form the header says they're in
+func getBits(h binaryHeader, data []byte) ([]uint64, error) {
+	if h.sparse {
+		return getSparse(data, h.size)
+	}
+	words := wordsFor(h.size)
+	if len(data) != 8*words {
+		return nil, fmt.Errorf("bloom: expected %d bytes of bit data for size %d, got %d", 8*words, h.size, len(data))
+	}
+	bits := getWords(data)
+	if err := checkSpareBits(bits, h.size); err != nil {
+		return nil, err
+	}
+	return bits, nil
+}
+
+// The last word usually has room for more bits than the filter has. Nothing ever sets those spare bits, so if any of
+// them are set the data is corrupt, and keeping them would make PopCount (and everything built on it) count bits
+// that aren't part of the filter
+func checkSpareBits(words []uint64, size int) error {
+	if spare := size % 64; spare != 0 && words[len(words)-1]>>spare != 0 {
+		return fmt.Errorf("bloom: bits are set past the end of a filter of size %d", size)
+	}
+	return nil
+}
+
+// Check the header at the start of data and pull out the parameters. This only looks at the header,
+// so it's up to the caller to check there are the right number of bytes after it
+func parseHeader(data []byte) (binaryHeader, error) {
+	if len(data) == 0 {
+		return binaryHeader{}, errors.New("bloom: data too short to be a serialized filter")
+	}
+	length, ok := headerLens[data[0]]
+	if !ok {
+		return binaryHeader{}, fmt.Errorf("bloom: unsupported format version %d", data[0])
+	}
+	if len(data) < length {
+		return binaryHeader{}, errors.New("bloom: data too short to be a serialized filter")
+	}
+	h := binaryHeader{
+		size:   int(binary.BigEndian.Uint64(data[1:])),
+		k:      int(binary.BigEndian.Uint64(data[9:])),
+		length: length,
+	}
+	if data[0] >= 2 {
+		h.inserts = int(binary.BigEndian.Uint64(data[17:]))
+	}
+	if data[0] >= 3 {
+		switch data[25] {
+		case denseFlag:
+		case sparseFlag:
+			h.sparse = true
+		default:
+			return binaryHeader{}, fmt.Errorf("bloom: unknown bit storage flag %d", data[25])
+		}
+	}
+	if data[0] >= 4 {
+		h.hasher = binary.BigEndian.Uint64(data[26:])
+	}
+	if err := checkParams(h.size, h.k, h.inserts); err != nil {
+		return binaryHeader{}, err
+	}
+	return h, nil
+}
+
+// Whether the data in h was saved by a filter with the same hasher as f (see hasherID)
+func (f *BloomFilter) checkHasher(h binaryHeader) error {
+	if h.hasher != 0 && h.hasher != f.hasherID() {
+		return fmt.Errorf("%w: the data was built with a different hasher", ErrIncompatibleFilters)
+	}
+	return nil
+}
+
+// Serialized filters might come from anywhere, including somewhere broken or hostile, so we can't trust the numbers
+// in them. Values too big for an int come out negative, and a size close to the biggest int would overflow when we
+// work out how many words it needs. A huge k is just as bad, because every Test makes a slice of k positions
+const (
+	maxSerializedSize = math.MaxInt - 63
+	maxSerializedK    = 1024 // Far more than any sensible filter uses: even a one-in-a-trillion error rate only needs 40
+)
+
+func checkParams(size, k, inserts int) error {
+	if size < 1 || size > maxSerializedSize {
+		return fmt.Errorf("bloom: invalid size %d", size)
+	}
+	if k < 1 || k > maxSerializedK {
+		return fmt.Errorf("bloom: invalid k %d", k)
+	}
+	// The same rule as Validate: each element needs k positions, and there are only size of them
+	if k > size {
+		return fmt.Errorf("bloom: k is %d, but it has to be between 1 and the size %d", k, size)
+	}
+	if inserts < 0 {
+		return fmt.Errorf("bloom: invalid Set count %d", inserts)
+	}
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (f *BloomFilter) MarshalBinary() ([]byte, error) {
+	f.init()
+	if f.useSparse() {
+		data := make([]byte, binaryHeaderLen, binaryHeaderLen+f.sparseLen())
+		f.putHeader(data, true)
+		return f.appendSparse(data), nil
+	}
+	data := make([]byte, binaryHeaderLen+8*len(f.bits))
+	f.putHeader(data, false)
+	putWords(data[binaryHeaderLen:], f.bits)
+	return data, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. It replaces whatever the filter held before, except for its
+// hasher: a Hasher is code, so it can't be saved, and the filter keeps the one it already had. So only load data into
+// a filter with the same hasher as the one that saved it (for a zero-value filter, that's DefaultHasher). Data from
+// a different hasher would load and then give false negatives, so it's rejected with ErrIncompatibleFilters (data
+// from before the hasher was saved is taken on trust)
+func (f *BloomFilter) UnmarshalBinary(data []byte) error {
+	h, err := parseHeader(data)
+	if err != nil {
+		return err
+	}
+	if err := f.checkHasher(h); err != nil {
+		return err
+	}
+	bits, err := getBits(h, data[h.length:])
+	if err != nil {
+		return err
+	}
+
+	f.load(bits, h.size, h.k, h.inserts)
+	return nil
+}
+
+// MergeBytes ORs a serialized filter straight into f, as if we'd unmarshalled it and taken the Union, but without
+// allocating a second filter along the way. This is useful when snapshots keep arriving from elsewhere and all you
+// want is the combination of them. The data has to have the same size, k and hasher as f (data from before the
+// hasher was saved is taken on trust). The namespace isn't part of the serialized form, so it's up to you to make
+// sure the data was built with the same one as f
+// If the data is malformed or doesn't match, f is left unchanged
+func (f *BloomFilter) MergeBytes(data []byte) error {
+	h, err := parseHeader(data)
+	if err != nil {
+		return err
+	}
+	f.lock()
+	defer f.unlock()
+	f.init()
+	if h.size != f.size || h.k != f.k {
+		return fmt.Errorf("%w: can't merge a filter with size %d and k %d into one with size %d and k %d", ErrIncompatibleFilters, h.size, h.k, f.size, f.k)
+	}
+	if err := f.checkHasher(h); err != nil {
+		return err
+	}
+	body := data[h.length:]
+	if h.sparse {
+		// Go through the sparse data once to check all of it, and only then a second time to set the bits, so that
+		// a bad gap near the end can't leave f half merged
+		each := func(fn func(pos int) error) error {
+			return readSparseBytes(body, func(r io.ByteReader) error { return eachSparseBit(r, f.size, fn) })
+		}
+		if err := each(func(int) error { return nil }); err != nil {
+			return err
+		}
+		each(func(pos int) error {
+			f.setBit(pos)
+			return nil
+		})
+	} else {
+		// The dense words can be ORed in straight from data. Only the last one needs checking first (see checkSpareBits)
+		if len(body) != 8*len(f.bits) {
+			return fmt.Errorf("bloom: expected %d bytes of bit data for size %d, got %d", 8*len(f.bits), f.size, len(body))
+		}
+		last := []uint64{binary.BigEndian.Uint64(body[len(body)-8:])}
+		if err := checkSpareBits(last, f.size); err != nil {
+			return err
+		}
+		for i := range f.bits {
+			f.bits[i] |= binary.BigEndian.Uint64(body[8*i:])
+		}
+	}
+	f.insertCount += h.inserts
+	return nil
+}
+
+// encoding/gob would find MarshalBinary and UnmarshalBinary on its own, but spelling out GobEncode and GobDecode
+// makes it clear that gob is supported, and that it uses exactly the same bytes as the binary format
+func (f *BloomFilter) GobEncode() ([]byte, error) {
+	return f.MarshalBinary()
+}
+
+func (f *BloomFilter) GobDecode(data []byte) error {
+	return f.UnmarshalBinary(data)
+}
+
+// A big filter can be many megabytes, and MarshalBinary needs all of that in memory at once on top of the filter
+// itself. WriteTo writes the same bytes straight to w instead, a chunk at a time. This implements io.WriterTo
+func (f *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	f.init()
+	sparse := f.useSparse()
+	var header [binaryHeaderLen]byte
+	f.putHeader(header[:], sparse)
+	n, err := w.Write(header[:])
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+	if sparse {
+		// Build the sparse form in a buffer the same size as a chunk of dense words, writing it out whenever it fills up
+		buf := make([]byte, 0, 8*streamChunkWords+binary.MaxVarintLen64)
+		flush := func() error {
+			n, err := w.Write(buf)
+			total += int64(n)
+			buf = buf[:0]
+			return err
+		}
+		buf = binary.AppendUvarint(buf, uint64(f.PopCount()))
+		prev := -1
+		for i, word := range f.bits {
+			for word != 0 {
+				index := i*64 + bits.TrailingZeros64(word)
+				word &= word - 1
+				buf = binary.AppendUvarint(buf, uint64(index-prev-1))
+				prev = index
+				if len(buf) >= 8*streamChunkWords {
+					if err := flush(); err != nil {
+						return total, err
+					}
+				}
+			}
+		}
+		return total, flush()
+	}
+
+	buf := make([]byte, 8*streamChunkWords)
+	for start := 0; start < len(f.bits); start += streamChunkWords {
+		chunk := f.bits[start:min(start+streamChunkWords, len(f.bits))]
+		putWords(buf, chunk)
+		n, err := w.Write(buf[:8*len(chunk)])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// How many words WriteTo and ReadFrom handle at a time
+const streamChunkWords = 512
+
+// ReadFrom reads a filter written by WriteTo (or MarshalBinary) from r, replacing whatever the filter held before.
+// This implements io.ReaderFrom. Unlike most ReadFrom methods it doesn't read until EOF: the header says exactly
+// how many bytes the filter takes up, so it stops there and leaves anything after it in r unread
+// Like UnmarshalBinary, it keeps the filter's hasher, and rejects data saved with a different one
+func (f *BloomFilter) ReadFrom(r io.Reader) (int64, error) {
+	// We can't know how long the header is until we've seen the version, so read that on its own first
+	var header [binaryHeaderLen]byte
+	n, err := io.ReadFull(r, header[:1])
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+	length, ok := headerLens[header[0]]
+	if !ok {
+		return total, fmt.Errorf("bloom: unsupported format version %d", header[0])
+	}
+	n, err = io.ReadFull(r, header[1:length])
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+	h, err := parseHeader(header[:length])
+	if err != nil {
+		return total, err
+	}
+	if err := f.checkHasher(h); err != nil {
+		return total, err
+	}
+	if h.sparse {
+		// The sparse form doesn't say how many bytes it takes up, only how many gaps follow, so we read it a byte at
+		// a time to make sure we don't read past the end of it
+		bits, err := readSparse(&countingByteReader{r: r, n: &total}, h.size)
+		if err != nil {
+			return total, err
+		}
+		f.load(bits, h.size, h.k, h.inserts)
+		return total, nil
+	}
+
+	// A header can claim any size it likes, but that doesn't mean the data is really there. Rather than allocating
+	// the whole bit array up front, which could be gigabytes, we grow it as the data actually arrives
+	words := wordsFor(h.size)
+	bits := make([]uint64, 0, min(words, streamChunkWords))
+	buf := make([]byte, 8*streamChunkWords)
+	for len(bits) < words {
+		chunk := min(words-len(bits), streamChunkWords)
+		n, err := io.ReadFull(r, buf[:8*chunk])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+		for i := 0; i < chunk; i++ {
+			bits = append(bits, binary.BigEndian.Uint64(buf[8*i:]))
+		}
+	}
+	if err := checkSpareBits(bits, h.size); err != nil {
+		return total, err
+	}
+	f.load(bits, h.size, h.k, h.inserts)
+	return total, nil
+}
+
+// An io.ByteReader that reads from r one byte at a time, adding up how many bytes it's read in n as it goes
+type countingByteReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingByteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	n, err := io.ReadFull(c.r, b[:])
+	*c.n += int64(n)
+	return b[0], err
+}
+
+// The JSON form is meant for debugging and config files, so it spells out the parameters by name. The bits are
+// the same packed words as the binary format, which encoding/json writes as a base64 string:
+//
+//	{"version":2,"size":1000,"k":3,"inserts":12,"bits":"AAAAAAAAAAA..."}
+//
+// Like the binary format, version 1 didn't have inserts, and can still be read. The JSON form never got a sparse
+// version, so it stays at version 2
+const jsonVersion = 2
+
+type jsonFilter struct {
+	Version int    `json:"version"`
+	Size    int    `json:"size"`
+	K       int    `json:"k"`
+	Inserts int    `json:"inserts"`
+	Bits    []byte `json:"bits"`
+}
+
+// MarshalJSON implements json.Marshaler
+func (f *BloomFilter) MarshalJSON() ([]byte, error) {
+	f.init()
+	bits := make([]byte, 8*len(f.bits))
+	putWords(bits, f.bits)
+	return json.Marshal(jsonFilter{Version: jsonVersion, Size: f.size, K: f.k, Inserts: f.insertCount, Bits: bits})
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It replaces whatever the filter held before
+func (f *BloomFilter) UnmarshalJSON(data []byte) error {
+	var j jsonFilter
+	if err := json.Unmarshal(data, &j); err != nil {
+		return fmt.Errorf("bloom: invalid JSON filter: %w", err)
+	}
+	if j.Version != 1 && j.Version != 2 {
+		return fmt.Errorf("bloom: unsupported format version %d", j.Version)
+	}
+	if err := checkParams(j.Size, j.K, j.Inserts); err != nil {
+		return err
+	}
+	words := wordsFor(j.Size)
+	if len(j.Bits) != 8*words {
+		return fmt.Errorf("bloom: expected %d bytes of bit data for size %d, got %d", 8*words, j.Size, len(j.Bits))
+	}
+	bits := getWords(j.Bits)
+	if err := checkSpareBits(bits, j.Size); err != nil {
+		return err
+	}
+	f.load(bits, j.Size, j.K, j.Inserts)
+	return nil
+}
+
+// The text form is for places that only take text, like environment variables or YAML files. It's the binary
+// form encoded as base64, with the size and k written out in front so a person can tell what it is at a glance:
+//
+//	m=1000,k=3:AgAAAAAAAAPoAAAAAAAAAAMAAAAA...
+//
+// MarshalText implements encoding.TextMarshaler
+func (f *BloomFilter) MarshalText() ([]byte, error) {
+	data, err := f.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return fmt.Appendf(nil, "m=%d,k=%d:%s", f.size, f.k, base64.StdEncoding.EncodeToString(data)), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It replaces whatever the filter held before
+func (f *BloomFilter) UnmarshalText(text []byte) error {
+	prefix, encoded, ok := strings.Cut(string(text), ":")
+	if !ok {
+		return errors.New("bloom: text filter is missing its m=...,k=...: prefix")
+	}
+	var size, k int
+	if _, err := fmt.Sscanf(prefix, "m=%d,k=%d", &size, &k); err != nil {
+		return fmt.Errorf("bloom: invalid text filter prefix %q", prefix)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("bloom: invalid base64 in text filter: %w", err)
+	}
+
+	// Decode into a filter with f's hasher, so the hasher check compares the data against the right one
+	decoded := BloomFilter{hasher: f.hasher}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	// The prefix is only there for people to read, but if it disagrees with the real header something has gone wrong
+	if decoded.size != size || decoded.k != k {
+		return fmt.Errorf("bloom: text filter prefix says m=%d,k=%d but the data has m=%d,k=%d", size, k, decoded.size, decoded.k)
+	}
+	f.load(decoded.bits, decoded.size, decoded.k, decoded.insertCount)
+	return nil
+}
+
+// Replace the filter's bits and parameters with ones that came from somewhere else. Everything Set keeps track of
+// besides the bits (the insertion log, the observed position range and the collision counters) described the old
+// bits, so it goes back to how Reset leaves it
+func (f *BloomFilter) load(bits []uint64, size, k, inserts int) {
+	f.bits = bits
+	f.size = size
+	f.k = k
+	f.insertCount = inserts
+	f.insertLog = nil
+	f.observed = false
+	if f.instrumented {
+		f.touches = make([]int, size)
+	}
+}
+
+// The packed words themselves, for handing to something that isn't this package, like a visualisation tool or another
+// bloom filter library. Bit number pos is bit pos%64 of word pos/64, the lowest bit being 0. Any bits in the last
+// word past Size are always 0. This is a copy, so changing it doesn't change the filter
+func (f *BloomFilter) Bits() []uint64 {
+	f.rlock()
+	defer f.runlock()
+	f.init()
+	return append([]uint64(nil), f.bits...)
+}
+
+// The other way round from Bits: replace the filter's bits with words that came from somewhere else, laid out the
+// same way. This only works if the other library hashes elements exactly the way this filter does, or the positions
+// won't mean the same thing. There have to be exactly enough words for size bits, and the spare bits past size in
+// the last word have to be 0. The words are copied, and the InsertCount goes back to 0, since we've no idea how many
+// elements went into them
+func (f *BloomFilter) SetBitsRaw(words []uint64, size, k int) error {
+	if err := checkParams(size, k, 0); err != nil {
+		return err
+	}
+	if len(words) != wordsFor(size) {
+		return fmt.Errorf("bloom: size %d needs %d words, got %d", size, wordsFor(size), len(words))
+	}
+	if err := checkSpareBits(words, size); err != nil {
+		return err
+	}
+	f.lock()
+	defer f.unlock()
+	f.load(append([]uint64(nil), words...), size, k, 0)
+	return nil
+}
+
+// Check that the filter's insides make sense together, and say what's wrong if they don't. This is mostly for
+// debugging filters loaded from somewhere: a failure means something got corrupted, perhaps in a way that got past
+// the checks in UnmarshalBinary. The one way to fail without any corruption is to ask for a k bigger than the size,
+// which NewBloomFilter allows but which can't work, since each element would need more positions than there are. The
+// decoders and SetBitsRaw refuse that too (see checkParams), so a filter like that can be saved but not loaded
+// A zero-value filter that hasn't been used yet is fine
+func (f *BloomFilter) Validate() error {
+	f.rlock()
+	defer f.runlock()
+	if f.bits == nil && f.size == 0 {
+		return nil
+	}
+	if f.size < 1 {
+		return fmt.Errorf("bloom: invalid size %d", f.size)
+	}
+	if len(f.bits) != wordsFor(f.size) {
+		return fmt.Errorf("bloom: size %d needs %d words, but there are %d", f.size, wordsFor(f.size), len(f.bits))
+	}
+	if err := checkSpareBits(f.bits, f.size); err != nil {
+		return err
+	}
+	if f.k < 1 || f.k > f.size {
+		return fmt.Errorf("bloom: k is %d, but it has to be between 1 and the size %d", f.k, f.size)
+	}
+	if f.insertCount < 0 {
+		return fmt.Errorf("bloom: invalid Set count %d", f.insertCount)
+	}
+	// The seed is only there to remember what the hasher was given, so the two have to agree. The namespace can be
+	// anything at all, including empty
+	if f.seed != 0 && f.hasher != (Hasher(DefaultHasher{Seed: f.seed})) {
+		return fmt.Errorf("bloom: the filter has seed %d, but its hasher isn't DefaultHasher with that seed", f.seed)
+	}
+	if f.instrumented && len(f.touches) != f.size {
+		return fmt.Errorf("bloom: size %d needs %d collision counters, but there are %d", f.size, f.size, len(f.touches))
+	}
+	return nil
+}
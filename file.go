@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A filter file is the binary format (see encoding.go) with a 4-byte "magic number" in front. Any file could
+// happen to start with a plausible version byte, but it's very unlikely to start with these exact four bytes,
+// so checking them first means that handing LoadFromFile the wrong file gives a clear error straight away instead
+// of a filter full of nonsense. After the magic comes the binary format, starting with its version byte
+var fileMagic = []byte("BLMF")
+
+// Save the filter to a file, replacing the file if it already exists
+func (f *BloomFilter) SaveToFile(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	if _, err := w.Write(fileMagic); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := f.WriteTo(w); err != nil {
+		file.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Load a filter saved by SaveToFile. Files with the wrong magic number, a version we don't know, or the wrong
+// amount of data for their size are all rejected with an error saying which
+func LoadFromFile(path string) (*BloomFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+
+	magic := make([]byte, len(fileMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, fmt.Errorf("%s: too short to be a filter file", path)
+	}
+	if !bytes.Equal(magic, fileMagic) {
+		return nil, fmt.Errorf("%s: not a filter file (bad magic number %q)", path, magic)
+	}
+
+	filter := &BloomFilter{}
+	if _, err := filter.ReadFrom(r); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%s: file is truncated", path)
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		return nil, fmt.Errorf("%s: unexpected data after the end of the filter", path)
+	}
+	return filter, nil
+}
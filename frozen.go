@@ -0,0 +1,32 @@
+package main
+
+// Once a filter is built, you often want to hand it to other code that should only ever query it. A
+// FrozenBloomFilter is a read-only view of a filter: it has Test but no Set, no Reset and no way to get at the
+// filter underneath, so the compiler stops anyone from changing it by accident
+//
+// The view shares the original's bits rather than copying them, so it's cheap to make, but it also means the
+// view sees any changes made through the original. Freeze a filter once you've finished building it
+// (or use Clone().Frozen() if you need to keep changing the original)
+type FrozenBloomFilter struct {
+	filter *BloomFilter
+}
+
+func (f *BloomFilter) Frozen() *FrozenBloomFilter {
+	return &FrozenBloomFilter{filter: f}
+}
+
+func (v *FrozenBloomFilter) Test(data []byte) bool {
+	return v.filter.Test(data)
+}
+
+func (v *FrozenBloomFilter) PopCount() int {
+	return v.filter.PopCount()
+}
+
+func (v *FrozenBloomFilter) Size() int {
+	return v.filter.Size()
+}
+
+func (v *FrozenBloomFilter) K() int {
+	return v.filter.K()
+}
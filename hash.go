@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+)
+
+// A Hasher is what turns an element into positions in the bit array. Different hash functions make different
+// tradeoffs between speed and how evenly they spread elements out, so the filter lets you choose
+type Hasher interface {
+	// Hash returns the i-th hash of data, for i from 0 up to k-1. It has to give the same answer every time
+	// for the same data and i. It can be any int at all: the filter takes care of squeezing it down to fit
+	// the bit array
+	Hash(data []byte, i int) int
+}
+
+// Hashers that use double hashing (see DefaultHasher) get all k hashes from the same h1 and h2. Calling Hash k times
+// would read the whole key k times over to work those out again, which adds up for long keys: a 64KB key with k = 7
+// means hashing almost half a megabyte. Hashers that implement this let us read the key once instead
+type doubleHasher interface {
+	hashPair(data []byte) (h1, h2 uint64)
+}
+
+// Some hashers can keep their hash inside the bit array as they go, rather than working out a big number for us to
+// reduce afterwards. Hashers that implement this get asked for positions directly, already between 0 and size-1
+type modHasher interface {
+	hashMod(data []byte, i, size int) int
+}
+
+// The i-th hash from a double hashing pair. Clearing the top bit keeps the result from turning negative when we
+// convert it to an int
+func doubleHash(h1, h2 uint64, i int) int {
+	return int((h1 + uint64(i)*h2) & math.MaxInt)
+}
+
+// Ask the hasher for each of the k hashes and turn them into positions in a bit array of the given size
+func hashPositions(hasher Hasher, data []byte, size, k int) []int {
+	if mod, ok := hasher.(modHasher); ok {
+		positions := make([]int, k)
+		for i := range positions {
+			positions[i] = mod.hashMod(data, i, size)
+		}
+		return positions
+	}
+
+	var h1, h2 uint64
+	pair, isPair := hasher.(doubleHasher)
+	if isPair {
+		h1, h2 = pair.hashPair(data)
+	}
+
+	positions := make([]int, k)
+	for i := range positions {
+		var h int
+		if isPair {
+			h = doubleHash(h1, h2, i)
+		} else {
+			h = hasher.Hash(data, i)
+		}
+		// Taking the remainder after dividing by the size makes sure every position lands inside the array.
+		// In Go the remainder of a negative number is negative too, so those need moving back up into range
+		pos := h % size
+		if pos < 0 {
+			pos += size
+		}
+		positions[i] = pos
+	}
+	return positions
+}
+
+// Filters with different hashers put the same element in different positions, so combining them gives nonsense
+// without any sign that something's wrong. To catch that, every hasher gets an ID, which the set operations compare
+// and the binary format saves. We can't ask an arbitrary Hasher who it is, but we can ask it to hash something:
+// hashers that agree on a few fixed hashes are almost certainly the same, while different types, seeds or keys give
+// different answers. DefaultHasher with no seed (which most filters use) skips that and gets a fixed ID
+const defaultHasherID = 1
+
+var hasherProbe = []byte("bloom: hasher fingerprint")
+
+func (f *BloomFilter) hasherID() uint64 {
+	hasher := f.hasherOrDefault()
+	if hasher == (Hasher(DefaultHasher{})) {
+		return defaultHasherID
+	}
+	fingerprint := fnv.New64a()
+	var buf [8]byte
+	for i := range 4 {
+		binary.BigEndian.PutUint64(buf[:], uint64(hasher.Hash(hasherProbe, i)))
+		fingerprint.Write(buf[:])
+	}
+	return fingerprint.Sum64()
+}
+
+// DefaultHasher uses FNV-1a, a simple and fast non-cryptographic hash from the standard library. Rather than needing
+// k completely independent hash functions, we use a trick called "double hashing": split one 64-bit hash into two
+// 32-bit halves h1 and h2, and compute the i-th hash as h1 + i*h2. This is known to be just as good as k independent
+// hashes for a bloom filter
+//
+// Seed changes every hash, so that the same data lands on different positions. It's fed into FNV ahead of the data,
+// like a salt. A seed of 0 means no salt at all
+type DefaultHasher struct {
+	Seed uint64
+}
+
+func (h DefaultHasher) Hash(data []byte, i int) int {
+	h1, h2 := h.hashPair(data)
+	return doubleHash(h1, h2, i)
+}
+
+func (h DefaultHasher) hashPair(data []byte) (h1, h2 uint64) {
+	hash := fnv.New64a()
+	if h.Seed != 0 {
+		var seed [8]byte
+		binary.BigEndian.PutUint64(seed[:], h.Seed)
+		hash.Write(seed[:])
+	}
+	hash.Write(data)
+	sum := hash.Sum64()
+	// FNV is good at spreading out the low bits but not so good at the high bits, which is a problem when h2 comes
+	// from the high half. Short keys that differ only in their last byte end up with nearly the same h2, and their
+	// positions clump together. Scrambling the hash with a few shifts and a multiply (the "finalizer" from
+	// MurmurHash3) mixes every input bit into every output bit
+	sum ^= sum >> 33
+	sum *= 0xff51afd7ed558ccd
+	sum ^= sum >> 33
+	return sum & 0xffffffff, sum >> 32
+}
+
+// LegacyHasher is the hash this filter started out with: add up the bytes of the data, each shifted right by one
+// bit for the first hash or by two bits for the second. It's here so you can see for yourself how much worse it is.
+// Adding bytes up means "ab" and "ba" always collide, and because it only has two different hashes, any k above 2
+// just sets the same two bits again
+//
+// A plain running total overflows on a big enough input, wrapping round to a negative number (which happens after
+// only 16MB or so when int is 32 bits). Instead we take the remainder after every byte, which keeps the total small
+// without changing the answer: the position comes out the same as the remainder of the whole sum would have been
+type LegacyHasher struct{}
+
+func (h LegacyHasher) Hash(data []byte, i int) int {
+	return h.hashMod(data, i, math.MaxInt)
+}
+
+func (LegacyHasher) hashMod(data []byte, i, size int) int {
+	shift := 1 + i%2
+	// The total is always less than size, which is at most math.MaxInt, so adding one more byte to it can't overflow a uint64
+	var sum uint64
+	for _, b := range data {
+		sum = (sum + uint64(b>>shift)) % uint64(size)
+	}
+	return int(sum)
+}
+
+// SHA256Hasher is for filters that have to cope with keys chosen by someone hostile. With a fast, well-known hash
+// like FNV, an attacker can search offline for lots of keys that all land on the same few positions, and use them
+// to fill the filter up or make it report false positives on purpose. SHA-256 makes that kind of search
+// impractical. It's also much slower than FNV, several times over for short keys, so only use it if you need it
+//
+// SHA-256 on its own is public, though: an attacker can still compute exactly where any key will land. Setting Key
+// to a secret (and keeping it secret) switches to HMAC-SHA256, so that without the key the positions can't be
+// predicted at all. Two filters with different keys are not compatible with each other
+type SHA256Hasher struct {
+	Key []byte
+}
+
+func (h SHA256Hasher) Hash(data []byte, i int) int {
+	h1, h2 := h.hashPair(data)
+	return doubleHash(h1, h2, i)
+}
+
+func (h SHA256Hasher) hashPair(data []byte) (h1, h2 uint64) {
+	var sum []byte
+	if len(h.Key) > 0 {
+		mac := hmac.New(sha256.New, h.Key)
+		mac.Write(data)
+		sum = mac.Sum(nil)
+	} else {
+		digest := sha256.Sum256(data)
+		sum = digest[:]
+	}
+	// 32 bytes of hash is far more than we need, so we use the first 16 for the same double hashing trick as DefaultHasher
+	return binary.BigEndian.Uint64(sum[0:8]), binary.BigEndian.Uint64(sum[8:16])
+}
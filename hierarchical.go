@@ -0,0 +1,58 @@
+package main
+
+// A really big filter is spread over so much memory that nearly every Test has to wait for a cache miss, one for each
+// of its k positions. A hierarchical filter puts a much smaller "coarse" filter in front of the big "fine" one, and
+// adds every element to both. Test asks the coarse filter first, and only goes on to the fine one if the coarse
+// one says yes. The coarse filter is small enough to stay in the CPU cache, so when most of the elements you test
+// aren't there, most of them get turned away without touching the big one at all
+//
+// Both filters have to say yes for a positive, so there are no false negatives, and the false-positive rate is no
+// worse than the fine filter's on its own. The price is the memory and Set time for the coarse filter, and an
+// extra check for every element that does get past it
+type HierarchicalBloomFilter struct {
+	coarse *BloomFilter
+	fine   *BloomFilter
+}
+
+// The coarse filter should be small enough to fit in cache (a few hundred KB at most) and have a small k, since
+// each of its positions is a memory access too. It only needs to be good enough to reject most negatives
+// The fine filter is sized like a normal filter for the false-positive rate you want
+func NewHierarchicalBloomFilter(coarseSize, coarseK, fineSize, fineK int) *HierarchicalBloomFilter {
+	return &HierarchicalBloomFilter{
+		coarse: NewBloomFilterWithK(coarseSize, coarseK),
+		fine:   NewBloomFilterWithK(fineSize, fineK),
+	}
+}
+
+func (h *HierarchicalBloomFilter) init() {
+	if h.coarse == nil {
+		h.coarse = NewBloomFilter()
+		h.fine = NewBloomFilter()
+	}
+}
+
+func (h *HierarchicalBloomFilter) Set(data []byte) *HierarchicalBloomFilter {
+	h.init()
+	h.coarse.Set(data)
+	h.fine.Set(data)
+	return h
+}
+
+// Both filters use DefaultHasher (with no namespace), so an element's positions in either of them come from the same
+// h1 and h2. Working those out once and checking the bits straight away, instead of going through Test, means the
+// fine filter doesn't hash the element all over again, and neither of them has to allocate a slice of positions
+func (h *HierarchicalBloomFilter) Test(data []byte) bool {
+	h.init()
+	h1, h2 := DefaultHasher{}.hashPair(data)
+	return h.coarse.testPair(h1, h2) && h.fine.testPair(h1, h2)
+}
+
+// The same check as test, for a filter using DefaultHasher and no namespace, starting from the hash pair
+func (f *BloomFilter) testPair(h1, h2 uint64) bool {
+	for i := 0; i < f.k; i++ {
+		if !f.hasBit(doubleHash(h1, h2, i) % f.size) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+package main
+
+// A filter made with WithInstrumentation counts, for every position, how many Set calls have landed on it
+// Once a bit is set, every later element that lands there is a collision: it doesn't set anything new, and it's
+// one step closer to a false positive for some element nobody added. With a good hash the touches are spread
+// evenly, so no position has many more than the rest. A handful of positions with huge counts means the hash is
+// clumping elements together
+//
+// An element whose positions coincide (possible when k is big compared to the size) only counts once for each
+// position, since it's still just one Set call
+func (f *BloomFilter) recordTouches(positions []int) {
+	if len(f.touches) != f.size {
+		// The filter changed size under us, say by loading something into it. The old counts are about positions
+		// that don't mean the same thing any more, so start again
+		f.touches = make([]int, f.size)
+	}
+	for i, pos := range positions {
+		if !containsInt(positions[:i], pos) {
+			f.touches[pos]++
+		}
+	}
+}
+
+// k is small, so searching the earlier positions is quicker than building a set to look them up in
+func containsInt(values []int, v int) bool {
+	for _, other := range values {
+		if other == v {
+			return true
+		}
+	}
+	return false
+}
+
+// How many Set calls have touched each position, for every position that's been touched at least once. Any count
+// above 1 is a collision. A filter that wasn't made with WithInstrumentation doesn't keep these counts, and gets nil
+func (f *BloomFilter) CollisionReport() map[int]int {
+	f.rlock()
+	defer f.runlock()
+	if !f.instrumented {
+		return nil
+	}
+	report := make(map[int]int)
+	for pos, count := range f.touches {
+		if count > 0 {
+			report[pos] = count
+		}
+	}
+	return report
+}
+
+// The smallest and largest positions that any Set has touched since the filter was made or last Reset. With a good
+// hash, these get close to 0 and Size()-1 after only a few elements. If max stays far below Size()-1, the hasher
+// isn't producing big enough numbers to reach the whole bit array, and the part it never reaches is wasted
+// Unlike CollisionReport, this is always kept, since it's just two numbers. Before the first Set it's (-1, -1)
+func (f *BloomFilter) ObservedPositionRange() (min, max int) {
+	f.rlock()
+	defer f.runlock()
+	if !f.observed {
+		return -1, -1
+	}
+	return f.minPos, f.maxPos
+}
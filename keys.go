@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// The filter works on bytes, because that's what hash functions eat. But most keys start out as something else, and
+// converting them at every call site gets tedious. These are thin wrappers that do the conversion for you. Set and
+// Test are still the real thing underneath, so SetString("x") and Set([]byte("x")) add exactly the same element
+
+// Set with a string instead of bytes. Returns the filter so you can chain calls, just like Set
+func (f *BloomFilter) SetString(s string) *BloomFilter {
+	return f.Set([]byte(s))
+}
+
+// Test with a string instead of bytes
+func (f *BloomFilter) TestString(s string) bool {
+	return f.Test([]byte(s))
+}
+
+// Set with anything that has a String method, like your own ID types, using whatever String returns. Two values
+// that print the same are the same element as far as the filter is concerned
+func (f *BloomFilter) SetStringer(s fmt.Stringer) *BloomFilter {
+	return f.SetString(s.String())
+}
+
+// Test with anything that has a String method
+func (f *BloomFilter) TestStringer(s fmt.Stringer) bool {
+	return f.TestString(s.String())
+}
+
+// Numbers can be turned into bytes in lots of ways: "42" from strconv is two bytes, while encoding/binary gives eight,
+// in either byte order. Each way puts the same number in different positions, so mixing them up means a number added
+// one way is never found the other way. SetUint64 always uses the same 8 big-endian bytes, so as long as you stick
+// to SetUint64 and TestUint64 for numbers, that can't happen
+func (f *BloomFilter) SetUint64(v uint64) *BloomFilter {
+	return f.Set(binary.BigEndian.AppendUint64(nil, v))
+}
+
+// Test a number added with SetUint64
+func (f *BloomFilter) TestUint64(v uint64) bool {
+	return f.Test(binary.BigEndian.AppendUint64(nil, v))
+}
+
+// A normalizer for WithNormalizer that makes the filter ignore case, so Test("ABC") finds an earlier Set("abc")
+// ArrayWithBloomFilter compares the values themselves when it scans, so for a case-insensitive array, lowercase
+// the values before you add or test them instead
+func ToLowerNormalizer(data []byte) []byte {
+	return bytes.ToLower(data)
+}
@@ -1,97 +1,440 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"strconv"
+	"os"
+	"sync"
+)
+
+// The size of the bit array and the number of positions per element you get if you just write BloomFilter{}
+// instead of calling one of the constructors
+const (
+	defaultSize = 99
+	defaultK    = 2
 )
 
 // A bloom filter is an array of bits, a function for adding elements, and a function for testing if an element has probably been added
 type BloomFilter struct {
-	bits [99]bool // Every bloom filter begins with every bit set to 0: [0,0,0,0,0...]
+	bits []uint64 // Every bloom filter begins with every bit set to 0: [0,0,0,0,0...]
+	size int      // How many bits the filter has. The last word of bits may have some spare bits we never use
+	k    int      // How many bits each element sets. More bits per element means fewer false positives, up to a point
+
+	hasher    Hasher // How elements are turned into positions. If this is nil we use DefaultHasher
+	namespace []byte // Stuck on the front of every element before hashing, see WithNamespace
+	seed      uint64 // The seed given to DefaultHasher, see NewBloomFilterSeeded
+
+	normalize func([]byte) []byte // Applied to every element before anything else, see WithNormalizer
+
+	insertCount int // How many times Set has been called, see InsertCount
+
+	instrumented bool  // Set by WithInstrumentation
+	touches      []int // How many Set calls have touched each position, only kept when instrumented, see instrument.go
+
+	// The smallest and largest positions any Set has touched, see ObservedPositionRange. These only mean anything
+	// once observed is true
+	minPos, maxPos int
+	observed       bool
+
+	logInserts bool     // Set by WithInsertionLog
+	insertLog  [][]byte // Every key given to Set, in order, only kept when logInserts is set
+
+	mu *sync.RWMutex // Only set for filters made with NewSyncBloomFilter, see concurrent.go
+}
+
+// We could store the bit array as a []bool, but Go uses a whole byte for each bool, which wastes 7 out of every 8 bits.
+// Instead we pack 64 bits into each uint64 "word". Bit number pos lives in word pos/64, at position pos%64 inside that word
+func wordsFor(size int) int {
+	return (size + 63) / 64
+}
+
+// To set a single bit, we OR its word with a "mask" that has only that one bit set
+func (f *BloomFilter) setBit(pos int) {
+	f.bits[pos/64] |= 1 << (pos % 64)
+}
+
+// To read a single bit, we AND its word with the same mask. The result is non-zero only if the bit is set
+func (f *BloomFilter) hasBit(pos int) bool {
+	return f.bits[pos/64]&(1<<(pos%64)) != 0
+}
+
+// With no options you get the same filter as BloomFilter{}: 99 bits, k = 2 and DefaultHasher. Options change that,
+// for example NewBloomFilter(WithSize(10000), WithK(7)). See options.go for the full list
+func NewBloomFilter(opts ...Option) *BloomFilter {
+	f := &BloomFilter{size: defaultSize, k: defaultK}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if f.size < 1 {
+		panic("bloom: size must be at least 1")
+	}
+	if f.k < 1 {
+		panic("bloom: k must be at least 1")
+	}
+	f.bits = make([]uint64, wordsFor(f.size))
+	if f.instrumented {
+		f.touches = make([]int, f.size)
+	}
+	return f
+}
+
+// Setting more bits per element makes it less likely that some other element happens to have set all of them,
+// but it also fills up the bit array faster. For a big array, something like 5-10 is usually better than 2
+func NewBloomFilterWithK(size, k int) *BloomFilter {
+	return NewBloomFilter(WithSize(size), WithK(k))
+}
+
+// If you'd rather pick the hash function yourself, pass in any Hasher
+func NewBloomFilterWithHasher(size, k int, hasher Hasher) *BloomFilter {
+	return NewBloomFilter(WithSize(size), WithK(k), WithHasher(hasher))
 }
 
-// We need a function that takes an element and returns two positions between 0 and 99
+// Every filter made with the same size and k puts the same element in the same place, which is what lets you combine
+// them. A seed changes that: filters with different seeds scatter elements differently, while filters with the same
+// seed always agree, on every machine and every run. That's handy if you want reproducible results that don't
+// depend on the exact hash function, or if you want several filters that make independent mistakes
+// Only filters with the same seed can be combined with Union or Intersect
+func NewBloomFilterSeeded(size, k int, seed uint64) *BloomFilter {
+	return NewBloomFilter(WithSize(size), WithK(k), WithHasher(DefaultHasher{Seed: seed}))
+}
+
+// Usually you don't want to pick the size and k yourself. You know roughly how many elements you'll add and how
+// many false positives you can live with, and OptimalParameters can work out the rest
+// This panics if expectedItems is less than 1 or falsePositiveRate isn't strictly between 0 and 1
+func NewBloomFilterFor(expectedItems int, falsePositiveRate float64) *BloomFilter {
+	m, k := OptimalParameters(expectedItems, falsePositiveRate)
+	return NewBloomFilterWithK(m, k)
+}
+
+// When you already have every element in hand, this does the whole job in one go: size the filter for exactly that
+// many elements at the false-positive rate you want, add them all, and hand back the filter ready to Test
+// An empty list still gets a filter, sized as if for a single element
+func NewFromElements(items [][]byte, falsePositiveRate float64) *BloomFilter {
+	return NewBloomFilterFor(max(len(items), 1), falsePositiveRate).SetAll(items)
+}
+
+// For a quick one-off question in a script: is query probably one of items? This builds a filter over all of items
+// with a 1% false-positive rate, asks it, and throws it away. That's far more work than just comparing query with
+// every item, so it's only worth it for the convenience. If you have more than one query, build the filter once
+// with NewFromElements and Test it as many times as you like
+func ProbablyContains(items [][]byte, query []byte) bool {
+	return NewFromElements(items, 0.01).Test(query)
+}
+
+// A zero-value BloomFilter{} has no bit array yet, so we allocate the default one the first time it's needed
+func (f *BloomFilter) init() {
+	if f.bits == nil {
+		f.bits = make([]uint64, wordsFor(defaultSize))
+		f.size = defaultSize
+	}
+	if f.k == 0 {
+		f.k = defaultK
+	}
+}
+
+// Sometimes one filter is shared by several unrelated users, say one per customer. If customer A adds "bob" and
+// customer B asks about "bob", B gets a positive for A's element. Giving each user their own namespace fixes this:
+// the namespace is stuck on the front of every element before it's hashed, so "bob" in namespace "a" and "bob" in
+// namespace "b" are different elements that land on different positions
+// Set the namespace before adding anything, since elements added before the change wouldn't be found after it, and
+// this panics if the filter isn't empty. Returns the filter so you can write
+// NewBloomFilterWithK(1000, 3).WithNamespace([]byte("a")), and see options.go for more settings you can chain
+func (f *BloomFilter) WithNamespace(namespace []byte) *BloomFilter {
+	f.checkUnused("namespace")
+	f.namespace = append([]byte(nil), namespace...)
+	return f
+}
+
+// The number of bits in the filter, often called m
+// A zero-value filter reports the default it will be given the first time it's used
+func (f *BloomFilter) Size() int {
+	if f.size == 0 {
+		return defaultSize
+	}
+	return f.size
+}
+
+// The number of bits each element sets
+func (f *BloomFilter) K() int {
+	if f.k == 0 {
+		return defaultK
+	}
+	return f.k
+}
+
+// We need a function that takes an element and returns k positions in the bit array
 // This function must be deterministic: every time you run it with the same data, you have to get the same positions
-// In real life you'd use a proper hashing function, but here we just hack up our own
+// It also needs to spread positions evenly across the whole array, or some bits will fill up much faster than others
+// That's the job of a Hasher (see hash.go). Unless you pick a different one, we use DefaultHasher
 func (f *BloomFilter) getPositions(data []byte) []int {
-	p1 := 0
-	p2 := 0
-	for _, b := range data {
-		p1 += int(b >> 1)
-		p2 += int(b >> 2)
+	if f.normalize != nil {
+		data = f.normalize(data)
+	}
+	if len(f.namespace) > 0 {
+		data = append(append([]byte(nil), f.namespace...), data...)
+	}
+	return hashPositions(f.hasherOrDefault(), data, f.size, f.k)
+}
+
+func (f *BloomFilter) hasherOrDefault() Hasher {
+	if f.hasher == nil {
+		return DefaultHasher{}
 	}
-	p1, _ = strconv.Atoi(strconv.Itoa(p1)[:2])
-	p2, _ = strconv.Atoi(strconv.Itoa(p2)[:2])
-	return []int{p1, p2}
+	return f.hasher
 }
 
 // Adding an element to a bloom filter means setting a fixed number of bits to 1 in the bit array
 // Bits may never be set back to 0, under any circumstances
 func (f *BloomFilter) Set(data []byte) *BloomFilter {
-	for _, pos := range f.getPositions(data) {
-		f.bits[pos] = true
-	}
+	f.lock()
+	defer f.unlock()
+	f.set(data)
 	return f
 }
 
+// Set and Test take the lock (if there is one) and then do their real work in these, so that methods handling
+// many elements at once can take the lock a single time
+// set returns how many bits it changed from 0 to 1
+func (f *BloomFilter) set(data []byte) int {
+	f.init()
+	f.insertCount++
+	if f.logInserts {
+		f.insertLog = append(f.insertLog, append([]byte(nil), data...))
+	}
+	changed := 0
+	positions := f.getPositions(data)
+	for _, pos := range positions {
+		if !f.hasBit(pos) {
+			f.setBit(pos)
+			changed++
+		}
+	}
+	for _, pos := range positions {
+		if !f.observed || pos < f.minPos {
+			f.minPos = pos
+		}
+		if !f.observed || pos > f.maxPos {
+			f.maxPos = pos
+		}
+		f.observed = true
+	}
+	if f.instrumented {
+		f.recordTouches(positions)
+	}
+	return changed
+}
+
+// Like Set, but tells you how many bits went from 0 to 1. For a brand new element that's usually k (less if two of
+// its positions happen to coincide). 0 means every bit was already set, so the element was probably there already.
+// Adding these up as you go tells you how full the filter is without counting bits
+func (f *BloomFilter) SetCounted(data []byte) int {
+	f.lock()
+	defer f.unlock()
+	return f.set(data)
+}
+
 // To test if an element has been added to the bloom filter, we generate the bits that would have been
 // set to 1 when the element was added. If any of these bits are 0, we know for a fact that the element
 // has not been added
 // Note that the converse does not apply. If all the bits are 1, the element may still not have been added
 // if adding other elements has flipped the same bits
 func (f *BloomFilter) Test(data []byte) bool {
+	f.rlock()
+	defer f.runlock()
+	return f.test(data)
+}
+
+func (f *BloomFilter) test(data []byte) bool {
+	if f.bits == nil {
+		// Nothing has ever been added to a zero-value filter, so nothing can be in it
+		return false
+	}
 	for _, pos := range f.getPositions(data) {
-		hasBit := f.bits[pos]
-		if !hasBit {
+		if !f.hasBit(pos) {
 			return false
 		}
 	}
 	return true
 }
 
+// "Have I seen this before? If not, remember it" comes up a lot, for things like skipping duplicate work. Calling
+// Test then Set works out the same positions twice, but Set already has to look at every bit, and if it didn't need
+// to change any of them then every bit was already 1: exactly what Test would have checked
+// So this returns what Test would have said just before the element was added, false positives and all
+func (f *BloomFilter) TestAndSet(data []byte) bool {
+	f.lock()
+	defer f.unlock()
+	return f.set(data) == 0
+}
+
+// An empty key is perfectly valid as far as the filter is concerned: it hashes to some positions like everything
+// else. But if your program never means to add an empty key, one turning up is probably a bug somewhere upstream
+// (a missing field, a failed read), and silently adding it would hide that. These variants work exactly like
+// Set and Test but refuse nil or empty data with an error instead
+func (f *BloomFilter) SetChecked(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("bloom: cannot set an empty key")
+	}
+	f.Set(data)
+	return nil
+}
+
+func (f *BloomFilter) TestChecked(data []byte) (bool, error) {
+	if len(data) == 0 {
+		return false, errors.New("bloom: cannot test an empty key")
+	}
+	return f.Test(data), nil
+}
+
+// Bits can't be unset one element at a time, but we can throw everything away at once and start again.
+// This reuses the existing bit array, so a long-running program can recycle a filter without allocating a new one
+func (f *BloomFilter) Reset() {
+	f.lock()
+	defer f.unlock()
+	for i := range f.bits {
+		f.bits[i] = 0
+	}
+	for i := range f.touches {
+		f.touches[i] = 0
+	}
+	f.insertLog = nil
+	f.observed = false
+	f.insertCount = 0
+}
+
+// Every key that's been added to a filter made with WithInsertionLog, in the order they were added, going back to
+// when the filter was made or last Reset. Keys added more than once are in here more than once. A filter without
+// the log gets nil. The keys are copies, so changing them doesn't change the log
+func (f *BloomFilter) InsertedKeys() [][]byte {
+	f.rlock()
+	defer f.runlock()
+	if !f.logInserts {
+		return nil
+	}
+	keys := make([][]byte, len(f.insertLog))
+	for i, key := range f.insertLog {
+		keys[i] = append([]byte(nil), key...)
+	}
+	return keys
+}
+
+// The exact number of times Set has been called (including through SetAll and friends) since the filter was made
+// or last Reset. Unlike ApproxCount, this doesn't need to look at the bits at all, but it counts every call, so
+// adding the same element twice counts twice
+func (f *BloomFilter) InsertCount() int {
+	f.rlock()
+	defer f.runlock()
+	return f.insertCount
+}
+
+// A copy that shares nothing with the original, so you can change one without affecting the other
+// A filter made for concurrent use gets its own lock, rather than sharing the original's
+func (f *BloomFilter) Clone() *BloomFilter {
+	clone := &BloomFilter{
+		bits:      append([]uint64(nil), f.bits...),
+		size:      f.size,
+		k:         f.k,
+		hasher:    f.hasher,
+		namespace: f.namespace,
+		seed:      f.seed,
+		normalize: f.normalize,
+
+		insertCount: f.insertCount,
+
+		minPos:   f.minPos,
+		maxPos:   f.maxPos,
+		observed: f.observed,
+
+		instrumented: f.instrumented,
+		touches:      append([]int(nil), f.touches...),
+
+		logInserts: f.logInserts,
+		insertLog:  append([][]byte(nil), f.insertLog...),
+	}
+	if f.mu != nil {
+		clone.mu = &sync.RWMutex{}
+	}
+	return clone
+}
+
 // That's it! That's a functioning bloom filter in three tiny functions
 
 // ---------------------------------------------------------------------
 
-// Here's an example of a useful data structure that uses a bloom filter. It's an array of strings where every string that
-// gets added gets also added to a bloom filter. We can thus check if a string belongs to the array by first
-// asking the bloom filter. We only iterate over the array if the bloom filter can't rule the string out. For a
+// Here's an example of a useful data structure that uses a bloom filter. It's an array where every value that
+// gets added gets also added to a bloom filter. We can thus check if a value belongs to the array by first
+// asking the bloom filter. We only iterate over the array if the bloom filter can't rule the value out. For a
 // very large array, this could save a lot of time!
-type ArrayWithBloomFilter struct {
-	array  []string
-	filter *BloomFilter
+//
+// The array can hold any comparable type T. The bloom filter only understands bytes, so we also need a
+// function that turns each value into bytes. Two values that are equal must always turn into the same bytes
+type ArrayWithBloomFilter[T comparable] struct {
+	array   []T
+	filter  *BloomFilter
+	toBytes func(T) []byte
+	stats   ArrayStats
+
+	setBits         int     // How many bits are set in the filter, kept up to date so we don't have to count them
+	resizeThreshold float64 // How saturated the filter can get before we rebuild it bigger, see SetAutoResizeThreshold
+	noAutoResize    bool
+
+	index map[T]int // How many copies of each value the array holds, only kept after EnableIndex
+}
+
+// Most of the time you'll want an array of strings, so that's what you get by default
+func NewArrayWithBloomFilter() *ArrayWithBloomFilter[string] {
+	return NewArrayWithBloomFilterOf(StringToBytes)
 }
 
-func NewArrayWithBloomFilter() *ArrayWithBloomFilter {
-	arr := make([]string, 0)
+func NewArrayWithBloomFilterOf[T comparable](toBytes func(T) []byte) *ArrayWithBloomFilter[T] {
+	arr := make([]T, 0)
 	bf := BloomFilter{}
-	return &ArrayWithBloomFilter{arr, &bf}
+	return &ArrayWithBloomFilter[T]{array: arr, filter: &bf, toBytes: toBytes}
 }
 
-func (a *ArrayWithBloomFilter) Set(value string) {
-	a.filter.Set([]byte(value))      // Add the element to the bloom filter
-	a.array = append(a.array, value) // Add the element to the array
+// The conversion used by NewArrayWithBloomFilter. A string is already a sequence of bytes, so this is easy
+func StringToBytes(s string) []byte {
+	return []byte(s)
 }
 
-func (a *ArrayWithBloomFilter) Test(value string) bool {
-	hasElement := a.filter.Test([]byte(value))
+func (a *ArrayWithBloomFilter[T]) Set(value T) {
+	a.setBits += a.filter.SetCounted(a.toBytes(value)) // Add the element to the bloom filter
+	a.array = append(a.array, value)                   // Add the element to the array
+	a.resizeIfSaturated()                              // Give the filter more room if it's getting full (see array.go)
+	if a.index != nil {
+		a.index[value]++ // And to the index, if there is one (see EnableIndex)
+	}
+}
+
+func (a *ArrayWithBloomFilter[T]) Test(value T) bool {
+	hasElement := a.filter.Test(a.toBytes(value))
 	if !hasElement {
 		// We know the array doesn't have the element, since a bloom filter guarantees
 		// no false negatives
+		a.stats.FilterRejects++
 		return false
 	} else {
 		// Since a bloom filter doesn't guarantee no false positives, we need to check manually
-		// This will be a slow operation for a large array
-		for _, el := range a.array {
-			if el == value {
-				return true
-			}
+		// This will be a slow operation for a large array, unless it has an index (see EnableIndex)
+		a.stats.LinearScans++
+		if a.contains(value) {
+			return true
 		}
+		a.stats.FalsePositives++
 		return false
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		// There's a subcommand, so act as a command-line tool instead (see cli.go)
+		if err := runCLI(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	arr := NewArrayWithBloomFilter()
 	arr.Set("test")
 
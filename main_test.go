@@ -0,0 +1,2861 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run these with `go test -bench . *.go` to time Set, Test, getPositions and PopCount on filters of a few different
+// sizes, so you can see whether a change (a new hasher, a different storage layout) actually made things faster.
+// They report allocations too, since an extra allocation per call is an easy regression to miss
+//
+// A bigger filter doesn't mean more work per call, but it does mean the bits are spread over more memory, so
+// past a certain size most calls have to wait for a cache miss
+var benchSizes = []int{1_000, 100_000, 10_000_000}
+
+const (
+	benchK    = 7
+	benchKeys = 4096
+)
+
+// Make the keys up front, so we're timing the filter and not fmt.Sprintf
+func benchKeySet() [][]byte {
+	keys := make([][]byte, benchKeys)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+	return keys
+}
+
+// Run fn as a sub-benchmark for every size in benchSizes, named after the size
+func eachBenchSize(b *testing.B, fn func(b *testing.B, size int)) {
+	for _, size := range benchSizes {
+		b.Run("size="+strconv.Itoa(size), func(b *testing.B) {
+			b.ReportAllocs()
+			fn(b, size)
+		})
+	}
+}
+
+// A filter of the given size with only half the keys in it, so Test sees a mix of hits and misses
+func halfFullBenchFilter(size int, keys [][]byte) *BloomFilter {
+	filter := NewBloomFilterWithK(size, benchK)
+	for _, key := range keys[:len(keys)/2] {
+		filter.Set(key)
+	}
+	return filter
+}
+
+func BenchmarkSet(b *testing.B) {
+	keys := benchKeySet()
+	eachBenchSize(b, func(b *testing.B, size int) {
+		filter := NewBloomFilterWithK(size, benchK)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			filter.Set(keys[i%len(keys)])
+		}
+	})
+}
+
+func BenchmarkTest(b *testing.B) {
+	keys := benchKeySet()
+	eachBenchSize(b, func(b *testing.B, size int) {
+		filter := halfFullBenchFilter(size, keys)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			filter.Test(keys[i%len(keys)])
+		}
+	})
+	// The same Test with a filter an eighth of the size in front (see hierarchical.go). The keys that weren't added
+	// should mostly stop at the small filter, which matters more the less of the big one fits in cache
+	b.Run("layered", func(b *testing.B) {
+		eachBenchSize(b, func(b *testing.B, size int) {
+			hierarchical := NewHierarchicalBloomFilter(max(size/8, 1), 3, size, benchK)
+			for _, key := range keys[:len(keys)/2] {
+				hierarchical.Set(key)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				hierarchical.Test(keys[i%len(keys)])
+			}
+		})
+	})
+}
+
+func BenchmarkGetPositions(b *testing.B) {
+	keys := benchKeySet()
+	eachBenchSize(b, func(b *testing.B, size int) {
+		filter := NewBloomFilterWithK(size, benchK)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			filter.getPositions(keys[i%len(keys)])
+		}
+	})
+}
+
+// PopCount against the obvious way of checking every bit, to show what packing the bits buys us
+func BenchmarkPopCount(b *testing.B) {
+	keys := benchKeySet()
+	eachBenchSize(b, func(b *testing.B, size int) {
+		filter := halfFullBenchFilter(size, keys)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			filter.PopCount()
+		}
+	})
+	b.Run("naive", func(b *testing.B) {
+		eachBenchSize(b, func(b *testing.B, size int) {
+			filter := halfFullBenchFilter(size, keys)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				count := 0
+				for pos := 0; pos < filter.size; pos++ {
+					if filter.hasBit(pos) {
+						count++
+					}
+				}
+			}
+		})
+	})
+}
+
+// The rest of this file is tests, run with `go test *.go` (add -race for the concurrent ones). Most of them follow
+// the same pattern as the benchmarks: build a filter, put some keys in it, and check what comes back out
+
+// n distinct keys that all start with prefix, so tests can make sets that don't overlap
+func testKeys(prefix string, n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(prefix + strconv.Itoa(i))
+	}
+	return keys
+}
+
+// A bloom filter can say "maybe" about something that was never added, but it must never say "no" about
+// something that was
+func checkNoFalseNegatives(t *testing.T, filter interface{ Test([]byte) bool }, keys [][]byte) {
+	t.Helper()
+	for _, key := range keys {
+		if !filter.Test(key) {
+			t.Fatalf("%q was added but Test says it isn't there", key)
+		}
+	}
+}
+
+// Sizes that aren't a multiple of 64 leave spare bits in the last word, and a size below 64 has only that word
+func TestConfigurableSizes(t *testing.T) {
+	for _, size := range []int{10, 1000, 1_000_000} {
+		t.Run("size="+strconv.Itoa(size), func(t *testing.T) {
+			filter := NewBloomFilter(WithSize(size))
+			if filter.Size() != size {
+				t.Fatalf("Size is %d, want %d", filter.Size(), size)
+			}
+			keys := testKeys("key-", 100)
+			for _, key := range keys {
+				filter.Set(key)
+			}
+			checkNoFalseNegatives(t, filter, keys)
+			for _, pos := range filter.SetBits() {
+				if pos < 0 || pos >= size {
+					t.Fatalf("bit %d is set, outside a filter of size %d", pos, size)
+				}
+			}
+		})
+	}
+}
+
+// The fraction of keys that test positive. Used with keys that were never added, that's the false-positive rate
+func positiveRate(filter interface{ Test([]byte) bool }, keys [][]byte) float64 {
+	positives := 0
+	for _, key := range keys {
+		if filter.Test(key) {
+			positives++
+		}
+	}
+	return float64(positives) / float64(len(keys))
+}
+
+// With plenty of room, more bits per element means a false positive needs more coincidences
+func TestMoreHashesFewerFalsePositives(t *testing.T) {
+	added, absent := testKeys("in-", 1000), testKeys("out-", 10_000)
+	rates := map[int]float64{}
+	for _, k := range []int{2, 7} {
+		filter := NewBloomFilterWithK(10_000, k)
+		filter.SetAll(added)
+		checkNoFalseNegatives(t, filter, added)
+		rates[k] = positiveRate(filter, absent)
+	}
+	if rates[7] >= rates[2] {
+		t.Fatalf("k = 7 gives a false-positive rate of %.4f, no better than %.4f for k = 2", rates[7], rates[2])
+	}
+}
+
+// With 1000 strings in a filter sized for them, the false positives we actually see should be close to what the
+// formula in FalsePositiveRate predicts. Sampling 20,000 absent keys gives a couple of hundred positives, so the
+// measured rate is only good to a few tens of percent, which is all we ask of it
+func TestObservedFalsePositiveRate(t *testing.T) {
+	added := testKeys("word-", 1000)
+	filter := NewBloomFilterWithK(10_000, 7)
+	filter.SetAll(added)
+	checkNoFalseNegatives(t, filter, added)
+
+	want := filter.FalsePositiveRate(len(added))
+	got := positiveRate(filter, testKeys("other-", 20_000))
+	if got < want/2 || got > want*1.5 {
+		t.Fatalf("measured false-positive rate %.4f, but the formula predicts %.4f", got, want)
+	}
+}
+
+func TestApproxCount(t *testing.T) {
+	if count := NewBloomFilterWithK(1000, 3).ApproxCount(); count != 0 {
+		t.Fatalf("an empty filter has ApproxCount %d, want 0", count)
+	}
+
+	filter := NewBloomFilterWithK(100_000, 7)
+	filter.SetAll(testKeys("key-", 1000))
+	if count := filter.ApproxCount(); count < 950 || count > 1050 {
+		t.Fatalf("ApproxCount is %d after adding 1000 keys", count)
+	}
+
+	// Once every bit is set the formula would take the log of 0. Turning infinity into an int gives nonsense (on most
+	// machines a huge negative number), so this checks we get a sensible positive estimate instead
+	full := NewBloomFilterWithK(64, 3)
+	full.SetAll(testKeys("key-", 1000))
+	if full.PopCount() != full.Size() {
+		t.Fatalf("only %d of %d bits are set, so this isn't testing a full filter", full.PopCount(), full.Size())
+	}
+	count := full.ApproxCount()
+	if count < full.Size()/full.K() {
+		t.Fatalf("ApproxCount is %d for a full filter", count)
+	}
+}
+
+func TestUnion(t *testing.T) {
+	aKeys, bKeys := testKeys("a-", 200), testKeys("b-", 200)
+	a, b := NewBloomFilterWithK(10_000, 5), NewBloomFilterWithK(10_000, 5)
+	a.SetAll(aKeys)
+	b.SetAll(bKeys)
+
+	union, err := a.Union(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNoFalseNegatives(t, union, aKeys)
+	checkNoFalseNegatives(t, union, bKeys)
+	if union.PopCount() < a.PopCount() || union.PopCount() < b.PopCount() {
+		t.Fatalf("the union has %d bits set, fewer than one of its inputs (%d and %d)", union.PopCount(), a.PopCount(), b.PopCount())
+	}
+	// Neither input is changed
+	if positiveRate(a, bKeys) > 0.1 {
+		t.Fatal("a tests positive for b's keys after the union")
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	common := testKeys("both-", 200)
+	a, b := NewBloomFilterWithK(10_000, 5), NewBloomFilterWithK(10_000, 5)
+	a.SetAll(common).SetAll(testKeys("a-", 200))
+	b.SetAll(common).SetAll(testKeys("b-", 200))
+
+	intersection, err := a.Intersect(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNoFalseNegatives(t, intersection, common)
+	// Keys that were only in one filter can still test positive (see Intersect), but most of them shouldn't
+	if rate := positiveRate(intersection, testKeys("a-", 200)); rate > 0.2 {
+		t.Fatalf("%.0f%% of the keys only in a test positive in the intersection", rate*100)
+	}
+}
+
+func TestCountingUnset(t *testing.T) {
+	counting := NewCountingBloomFilter(1000, 3)
+	counting.Set([]byte("apple")).Set([]byte("banana"))
+	if !counting.Test([]byte("apple")) || !counting.Test([]byte("banana")) {
+		t.Fatal("added elements don't test positive")
+	}
+
+	counting.Unset([]byte("apple"))
+	if counting.Test([]byte("apple")) {
+		t.Fatal("apple still tests positive after Unset")
+	}
+	if !counting.Test([]byte("banana")) {
+		t.Fatal("removing apple also removed banana")
+	}
+
+	// Unsetting something that was never added does nothing
+	counting.Unset([]byte("cherry"))
+	if !counting.Test([]byte("banana")) {
+		t.Fatal("unsetting an absent element removed banana")
+	}
+	counting.Set([]byte("apple"))
+	if !counting.Test([]byte("apple")) {
+		t.Fatal("apple doesn't test positive after being added again")
+	}
+}
+
+func TestReset(t *testing.T) {
+	keys := testKeys("key-", 100)
+	filter := NewBloomFilterWithK(1000, 3)
+	filter.SetAll(keys)
+	filter.Reset()
+	if filter.PopCount() != 0 || filter.InsertCount() != 0 {
+		t.Fatalf("after Reset, %d bits are set and InsertCount is %d", filter.PopCount(), filter.InsertCount())
+	}
+	if rate := positiveRate(filter, keys); rate != 0 {
+		t.Fatalf("%.0f%% of the old keys still test positive after Reset", rate*100)
+	}
+	// The filter still works afterwards
+	filter.Set([]byte("again"))
+	if !filter.Test([]byte("again")) {
+		t.Fatal("a key added after Reset doesn't test positive")
+	}
+}
+
+// Bits on either side of a word boundary live in different words, which is where an off-by-one would show
+func TestBitsAcrossWordBoundaries(t *testing.T) {
+	filter := NewBloomFilterWithK(200, 1)
+	positions := []int{0, 62, 63, 64, 65, 127, 128, 199}
+	for _, pos := range positions {
+		filter.setBit(pos)
+	}
+	for pos := 0; pos < filter.Size(); pos++ {
+		if filter.hasBit(pos) != slices.Contains(positions, pos) {
+			t.Fatalf("bit %d is %v, but we only set %v", pos, filter.hasBit(pos), positions)
+		}
+	}
+	if got := filter.SetBits(); !slices.Equal(got, positions) {
+		t.Fatalf("SetBits is %v, want %v", got, positions)
+	}
+}
+
+// A filter that's been saved and loaded again has to give exactly the same answer as the original for every key,
+// whether it was added or not
+func checkSameAnswers(t *testing.T, want, got *BloomFilter, added [][]byte) {
+	t.Helper()
+	if got.Size() != want.Size() || got.K() != want.K() || got.InsertCount() != want.InsertCount() {
+		t.Fatalf("got size %d, k %d, %d inserts, want %d, %d, %d",
+			got.Size(), got.K(), got.InsertCount(), want.Size(), want.K(), want.InsertCount())
+	}
+	for _, key := range append(testKeys("absent-", 1000), added...) {
+		if got.Test(key) != want.Test(key) {
+			t.Fatalf("Test(%q) is %v, but %v before", key, got.Test(key), want.Test(key))
+		}
+	}
+}
+
+// A filter of the given size with n keys in it, along with the keys
+func filledFilter(size, k, n int) (*BloomFilter, [][]byte) {
+	keys := testKeys("key-", n)
+	return NewBloomFilterWithK(size, k).SetAll(keys), keys
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	original, keys := filledFilter(10_000, 5, 500)
+	data, err := original.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded BloomFilter
+	if err := loaded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	checkSameAnswers(t, original, &loaded, keys)
+
+	again, err := loaded.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, data) {
+		t.Fatal("marshalling the loaded filter gives different bytes")
+	}
+}
+
+func TestUnmarshalBinaryBadInput(t *testing.T) {
+	data, err := NewBloomFilterWithK(1000, 3).Set([]byte("x")).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := func(change func(data []byte) []byte) []byte {
+		return change(append([]byte(nil), data...))
+	}
+	cases := map[string][]byte{
+		"empty":          nil,
+		"short header":   data[:10],
+		"truncated bits": data[:len(data)-1],
+		"extra bytes":    append(append([]byte(nil), data...), 0),
+		"unknown version": corrupt(func(data []byte) []byte {
+			data[0] = 99
+			return data
+		}),
+		"zero k": corrupt(func(data []byte) []byte {
+			copy(data[9:17], make([]byte, 8))
+			return data
+		}),
+		"unknown flag": corrupt(func(data []byte) []byte {
+			data[25] = 7
+			return data
+		}),
+	}
+	for name, bad := range cases {
+		var f BloomFilter
+		if err := f.UnmarshalBinary(bad); err == nil {
+			t.Errorf("%s: UnmarshalBinary accepted it", name)
+		}
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	original, keys := filledFilter(1000, 4, 100)
+	data, err := json.Marshal(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded BloomFilter
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	checkSameAnswers(t, original, &loaded, keys)
+}
+
+func TestUnmarshalJSONBadInput(t *testing.T) {
+	cases := map[string]string{
+		"not JSON":        `{"size": `,
+		"unknown version": `{"version": 9, "size": 64, "k": 1, "bits": "AAAAAAAAAAA="}`,
+		"zero size":       `{"version": 2, "size": 0, "k": 1, "bits": ""}`,
+		"too few bits":    `{"version": 2, "size": 128, "k": 1, "bits": "AAAAAAAAAAA="}`,
+		"spare bits set":  `{"version": 2, "size": 8, "k": 1, "bits": "//////////8="}`,
+	}
+	for name, bad := range cases {
+		var f BloomFilter
+		if err := json.Unmarshal([]byte(bad), &f); err == nil {
+			t.Errorf("%s: UnmarshalJSON accepted %s", name, bad)
+		}
+	}
+}
+
+// Run with -race: any Set or Test that touches the bits without the lock shows up as a data race
+func TestSyncFilterConcurrentUse(t *testing.T) {
+	const goroutines, perGoroutine = 8, 500
+	filter := NewSyncBloomFilter(100_000, 5)
+	var wg sync.WaitGroup
+	for g := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keys := testKeys(strconv.Itoa(g)+"-", perGoroutine)
+			for i, key := range keys {
+				filter.Set(key)
+				if !filter.Test(key) {
+					t.Errorf("%q doesn't test positive straight after Set", key)
+				}
+				filter.Test(keys[(i+1)%len(keys)])
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := filter.InsertCount(); got != goroutines*perGoroutine {
+		t.Fatalf("InsertCount is %d, want %d", got, goroutines*perGoroutine)
+	}
+	for g := range goroutines {
+		checkNoFalseNegatives(t, filter, testKeys(strconv.Itoa(g)+"-", perGoroutine))
+	}
+}
+
+func TestArrayOfInts(t *testing.T) {
+	array := NewArrayWithBloomFilterOf(func(v int) []byte { return []byte(strconv.Itoa(v)) })
+	for v := range 100 {
+		array.Set(v * 2)
+	}
+	for v := range 200 {
+		if array.Test(v) != (v%2 == 0) {
+			t.Fatalf("Test(%d) is %v", v, array.Test(v))
+		}
+	}
+}
+
+// Any comparable type works, as long as equal values turn into the same bytes
+type testPoint struct{ x, y int }
+
+func TestArrayOfStructs(t *testing.T) {
+	array := NewArrayWithBloomFilterOf(func(p testPoint) []byte { return fmt.Appendf(nil, "%d,%d", p.x, p.y) })
+	array.Set(testPoint{1, 2})
+	array.Set(testPoint{3, 4})
+	if !array.Test(testPoint{1, 2}) || !array.Test(testPoint{3, 4}) {
+		t.Fatal("added points don't test positive")
+	}
+	if array.Test(testPoint{2, 1}) {
+		t.Fatal("a point that was never added tests positive")
+	}
+}
+
+// The formulas checked against values worked out by hand
+func TestFormulas(t *testing.T) {
+	parameters := []struct {
+		n    int
+		p    float64
+		m, k int
+	}{
+		{1_000_000, 0.01, 9_585_059, 7},
+		{1000, 0.001, 14_378, 10},
+		{1, 0.5, 2, 1},
+	}
+	for _, want := range parameters {
+		if m, k := OptimalParameters(want.n, want.p); m != want.m || k != want.k {
+			t.Errorf("OptimalParameters(%d, %v) is %d, %d, want %d, %d", want.n, want.p, m, k, want.m, want.k)
+		}
+	}
+
+	rates := []struct {
+		m, k, n int
+		want    float64
+	}{
+		{1000, 7, 100, 0.008194},
+		{10_000, 3, 1000, 0.017411},
+		{100, 1, 100, 0.632121},
+		{100, 3, 0, 0},
+	}
+	for _, rate := range rates {
+		got := NewBloomFilterWithK(rate.m, rate.k).FalsePositiveRate(rate.n)
+		if math.Abs(got-rate.want) > 1e-6 {
+			t.Errorf("FalsePositiveRate(%d) for m = %d, k = %d is %.6f, want %.6f", rate.n, rate.m, rate.k, got, rate.want)
+		}
+	}
+}
+
+func TestArrayRemove(t *testing.T) {
+	array := NewArrayWithBloomFilter()
+	for _, word := range []string{"apple", "banana", "apple", "cherry"} {
+		array.Set(word)
+	}
+	if !array.Remove("banana") || array.Test("banana") {
+		t.Fatal("banana is still there after Remove")
+	}
+	if array.filter.Test([]byte("banana")) {
+		t.Fatal("the rebuilt filter still has banana")
+	}
+	if array.Remove("banana") {
+		t.Fatal("Remove found banana a second time")
+	}
+	// Only the first copy goes
+	if !array.Remove("apple") || !array.Test("apple") {
+		t.Fatal("removing one apple removed both")
+	}
+	if !array.Test("cherry") {
+		t.Fatal("removing other values lost cherry")
+	}
+}
+
+func TestSaturationClimbs(t *testing.T) {
+	filter := NewBloomFilterWithK(1000, 3)
+	if filter.Saturation() != 0 {
+		t.Fatalf("an empty filter has saturation %v", filter.Saturation())
+	}
+	last := 0.0
+	for i, key := range testKeys("key-", 5000) {
+		filter.Set(key)
+		if i%100 != 0 {
+			continue
+		}
+		saturation := filter.Saturation()
+		if saturation < last || saturation > 1 {
+			t.Fatalf("saturation went from %v to %v", last, saturation)
+		}
+		last = saturation
+	}
+	if last < 0.99 || !filter.IsSaturated(0.99) {
+		t.Fatalf("saturation is only %v after adding five times as many keys as there are bits", last)
+	}
+}
+
+// Going a hundred times past the initial capacity means the filter has to keep growing, and each new filter adds
+// to the false-positive rate, but the total has to stay under what we asked for
+func TestScalableFalsePositiveBound(t *testing.T) {
+	const p = 0.01
+	scalable := NewScalableBloomFilter(100, p)
+	added := testKeys("in-", 10_000)
+	for _, key := range added {
+		scalable.Set(key)
+	}
+	if len(scalable.filters) < 5 {
+		t.Fatalf("only %d filters after 10,000 inserts", len(scalable.filters))
+	}
+	checkNoFalseNegatives(t, scalable, added)
+	if rate := positiveRate(scalable, testKeys("out-", 50_000)); rate > p {
+		t.Fatalf("false-positive rate %.4f is over the bound of %v", rate, p)
+	}
+}
+
+func TestString(t *testing.T) {
+	filter := NewBloomFilterWithK(16, 2)
+	filter.setBit(3)
+	filter.setBit(11)
+	want := "BloomFilter{size: 16, k: 2, set bits: 2, saturation: 12.5%, estimated count: 1, bits: 0001000000010000}"
+	if got := filter.String(); got != want {
+		t.Fatalf("got  %s\nwant %s", got, want)
+	}
+
+	// Big filters are summed up without the bits
+	big := NewBloomFilterWithK(1000, 3).String()
+	if !strings.HasPrefix(big, "BloomFilter{size: 1000, k: 3, set bits: 0,") || strings.Contains(big, "bits: 0000") {
+		t.Fatalf("unexpected summary of a big filter: %s", big)
+	}
+
+	var zero BloomFilter
+	if got := zero.String(); !strings.HasPrefix(got, "BloomFilter{size: 99, k: 2, set bits: 0,") {
+		t.Fatalf("unexpected summary of a zero-value filter: %s", got)
+	}
+}
+
+func TestCheckedEmptyKeys(t *testing.T) {
+	filter := NewBloomFilterWithK(1000, 3)
+	for _, empty := range [][]byte{nil, {}} {
+		if err := filter.SetChecked(empty); err == nil {
+			t.Fatalf("SetChecked(%#v) didn't return an error", empty)
+		}
+		if _, err := filter.TestChecked(empty); err == nil {
+			t.Fatalf("TestChecked(%#v) didn't return an error", empty)
+		}
+	}
+	if filter.InsertCount() != 0 {
+		t.Fatal("a refused key was added anyway")
+	}
+
+	if err := filter.SetChecked([]byte{'x'}); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := filter.TestChecked([]byte{'x'}); err != nil || !found {
+		t.Fatalf("TestChecked of a single byte gave %v, %v", found, err)
+	}
+}
+
+func TestEquals(t *testing.T) {
+	keys := testKeys("key-", 50)
+	a := NewBloomFilterWithK(1000, 3).SetAll(keys)
+	b := NewBloomFilterWithK(1000, 3).SetAll(keys)
+	if !a.Equals(b) || !b.Equals(a) {
+		t.Fatal("filters built from the same keys aren't equal")
+	}
+
+	// One bit out is enough. Pick one that isn't set yet
+	pos := 0
+	for b.hasBit(pos) {
+		pos++
+	}
+	b.setBit(pos)
+	if a.Equals(b) {
+		t.Fatal("filters a bit apart are equal")
+	}
+
+	if a.Equals(NewBloomFilterWithK(2000, 3).SetAll(keys)) || a.Equals(NewBloomFilterWithK(1000, 4).SetAll(keys)) {
+		t.Fatal("filters with different parameters are equal")
+	}
+	if a.Equals(nil) {
+		t.Fatal("a filter equals nil")
+	}
+}
+
+func TestCloneIsIndependent(t *testing.T) {
+	original := NewBloomFilterWithK(1000, 3).Set([]byte("shared"))
+	clone := original.Clone()
+	if !clone.Equals(original) || clone.InsertCount() != 1 {
+		t.Fatal("the clone isn't a copy of the original")
+	}
+
+	clone.Set([]byte("clone only"))
+	original.Set([]byte("original only"))
+	if original.Test([]byte("clone only")) || original.InsertCount() != 2 {
+		t.Fatal("setting the clone changed the original")
+	}
+	if clone.Test([]byte("original only")) || clone.InsertCount() != 2 {
+		t.Fatal("setting the original changed the clone")
+	}
+
+	original.Reset()
+	if !clone.Test([]byte("shared")) {
+		t.Fatal("resetting the original cleared the clone")
+	}
+}
+
+func TestWriteToReadFrom(t *testing.T) {
+	original, keys := filledFilter(10_000, 5, 500)
+	var buf bytes.Buffer
+	written, err := original.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := original.MarshalBinary()
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("WriteTo doesn't write the same bytes as MarshalBinary")
+	}
+
+	var loaded BloomFilter
+	read, err := loaded.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != written {
+		t.Fatalf("wrote %d bytes but read %d", written, read)
+	}
+	checkSameAnswers(t, original, &loaded, keys)
+
+	// A stream that stops early is an unexpected EOF, wherever it stops
+	for _, n := range []int{0, 5, binaryHeaderLen, len(data) - 1} {
+		var f BloomFilter
+		if _, err := f.ReadFrom(bytes.NewReader(data[:n])); !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			t.Errorf("reading %d of %d bytes gave %v", n, len(data), err)
+		}
+	}
+}
+
+func TestTestEachMatchesTest(t *testing.T) {
+	filter, keys := filledFilter(1000, 3, 100)
+	items := append(testKeys("absent-", 100), keys...)
+	results := filter.TestEach(items)
+	if len(results) != len(items) {
+		t.Fatalf("got %d results for %d items", len(results), len(items))
+	}
+	for i, item := range items {
+		if results[i] != filter.Test(item) {
+			t.Fatalf("TestEach says %v for %q, but Test says %v", results[i], item, !results[i])
+		}
+	}
+	if len(filter.TestEach(nil)) != 0 {
+		t.Fatal("TestEach of nothing isn't empty")
+	}
+
+	// SetAll is the same as calling Set for each key in turn
+	oneByOne := NewBloomFilterWithK(1000, 3)
+	for _, key := range keys {
+		oneByOne.Set(key)
+	}
+	if !oneByOne.Equals(filter) || oneByOne.InsertCount() != filter.InsertCount() {
+		t.Fatal("SetAll and Set give different filters")
+	}
+}
+
+func TestArrayStats(t *testing.T) {
+	array := NewArrayWithBloomFilter()
+	for _, key := range testKeys("in-", 20) {
+		array.Set(string(key))
+	}
+	for _, key := range testKeys("in-", 20) {
+		array.Test(string(key))
+	}
+	stats := array.Stats()
+	if stats != (ArrayStats{LinearScans: 20}) {
+		t.Fatalf("after testing 20 values that are there, stats are %+v", stats)
+	}
+
+	// Every miss is either rejected by the filter or scanned for nothing
+	for _, key := range testKeys("out-", 100) {
+		array.Test(string(key))
+	}
+	stats = array.Stats()
+	if stats.FilterRejects+stats.FalsePositives != 100 || stats.LinearScans != 20+stats.FalsePositives {
+		t.Fatalf("after testing 100 values that aren't there, stats are %+v", stats)
+	}
+	if stats.FilterRejects < 50 {
+		t.Fatalf("the filter only ruled out %d of 100 values", stats.FilterRejects)
+	}
+}
+
+func TestFilterForMeetsItsRate(t *testing.T) {
+	for _, p := range []float64{0.1, 0.01, 0.001} {
+		added := testKeys("in-", 1000)
+		filter := NewBloomFilterFor(len(added), p)
+		filter.SetAll(added)
+		checkNoFalseNegatives(t, filter, added)
+		// Enough samples to expect at least a hundred false positives, so the measured rate is close to the real one
+		rate := positiveRate(filter, testKeys("out-", int(100/p)))
+		if rate > p*1.3 {
+			t.Errorf("a filter sized for %v has a false-positive rate of %v", p, rate)
+		}
+	}
+}
+
+func TestArrayMerge(t *testing.T) {
+	a, b := NewArrayWithBloomFilter(), NewArrayWithBloomFilter()
+	a.Set("apple")
+	b.Set("banana")
+	b.Set("apple")
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, word := range []string{"apple", "banana"} {
+		if !a.Test(word) {
+			t.Fatalf("%s is missing after the merge", word)
+		}
+	}
+	if len(a.array) != 3 || len(b.array) != 2 {
+		t.Fatalf("the arrays hold %d and %d values after the merge", len(a.array), len(b.array))
+	}
+
+	// Arrays whose filters have grown to different sizes get rebuilt at the bigger one
+	big := NewArrayWithBloomFilter()
+	for _, key := range testKeys("big-", 1000) {
+		big.Set(string(key))
+	}
+	if err := a.Merge(big); err != nil {
+		t.Fatal(err)
+	}
+	if a.filter.Size() < big.filter.Size() {
+		t.Fatalf("the merged filter has size %d, smaller than %d", a.filter.Size(), big.filter.Size())
+	}
+	for _, key := range append(testKeys("big-", 1000), []byte("apple"), []byte("banana")) {
+		if !a.filter.Test(key) {
+			t.Fatalf("%s is missing after merging arrays of different sizes", key)
+		}
+	}
+}
+
+func TestPartitioned(t *testing.T) {
+	const size, k = 1000, 4
+	partitioned := NewPartitionedBloomFilter(size, k)
+	keys := testKeys("key-", 100)
+	for _, key := range keys {
+		positions := partitioned.getPositions(key)
+		for i, pos := range positions {
+			if pos < i*(size/k) || pos >= (i+1)*(size/k) {
+				t.Fatalf("position %d of %q is %d, outside partition %d", i, key, pos, i)
+			}
+		}
+		partitioned.Set(key)
+	}
+	checkNoFalseNegatives(t, partitioned, keys)
+	if rate := positiveRate(partitioned, testKeys("absent-", 1000)); rate > 0.05 {
+		t.Fatalf("false-positive rate is %v", rate)
+	}
+}
+
+func TestFrequencyNeverUndercounts(t *testing.T) {
+	counting := NewCountingBloomFilter(500, 3)
+	keys := testKeys("key-", 100)
+	for i, key := range keys {
+		for range i%5 + 1 {
+			counting.Set(key)
+		}
+	}
+	for i, key := range keys {
+		if got := counting.Frequency(key); int(got) < i%5+1 {
+			t.Fatalf("Frequency(%q) is %d, but it was added %d times", key, got, i%5+1)
+		}
+	}
+	// A key that tests negative has a counter at 0, so it can't have been added at all
+	for _, key := range testKeys("absent-", 100) {
+		if !counting.Test(key) && counting.Frequency(key) != 0 {
+			t.Fatalf("Frequency(%q) is %d, but it tests negative", key, counting.Frequency(key))
+		}
+	}
+}
+
+func TestCLIAddAndTest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "words.bloom")
+	run := func(args ...string) string {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		if err := runCLI(append([]string{"-file", path}, args...), nil, &stdout, &stderr); err != nil {
+			t.Fatalf("%v: %v\n%s", args, err, stderr.String())
+		}
+		return stdout.String()
+	}
+
+	if got := run("-size", "5000", "add", "apple", "banana"); got != "added 2 words to "+path+"\n" {
+		t.Fatalf("add printed %q", got)
+	}
+	// A second add goes into the same filter
+	run("add", "cherry")
+	for _, word := range []string{"apple", "banana", "cherry"} {
+		if got := run("test", word); got != word+": probably present\n" {
+			t.Fatalf("test printed %q", got)
+		}
+	}
+	if got := run("test", "durian"); got != "durian: definitely not present\n" {
+		t.Fatalf("test printed %q", got)
+	}
+
+	filter, err := LoadFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.Size() != 5000 || filter.InsertCount() != 3 {
+		t.Fatalf("the file holds a filter with size %d and %d inserts", filter.Size(), filter.InsertCount())
+	}
+
+	if err := runCLI([]string{"-file", path, "frobnicate"}, nil, io.Discard, io.Discard); err == nil {
+		t.Fatal("an unknown command didn't give an error")
+	}
+}
+
+func TestLoadFromReader(t *testing.T) {
+	array := NewArrayWithBloomFilter()
+	loaded, err := LoadFromReader(array, strings.NewReader("apple\n\nbanana\n   \ncherry"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != 3 || len(array.array) != 3 {
+		t.Fatalf("loaded %d lines into an array of %d, want 3", loaded, len(array.array))
+	}
+	for _, word := range []string{"apple", "banana", "cherry"} {
+		if !array.Test(word) {
+			t.Fatalf("%s is missing", word)
+		}
+	}
+	if array.Test("") {
+		t.Fatal("a blank line was loaded")
+	}
+}
+
+func TestSetBitsMatchesPositions(t *testing.T) {
+	filter := NewBloomFilterWithK(10_000, 7)
+	key := []byte("hello")
+	filter.Set(key)
+	positions := filter.getPositions(key)
+	slices.Sort(positions)
+	if got := filter.SetBits(); !slices.Equal(got, slices.Compact(positions)) {
+		t.Fatalf("SetBits is %v, but the positions of %q are %v", got, key, positions)
+	}
+	if got := NewBloomFilterWithK(100, 2).SetBits(); len(got) != 0 {
+		t.Fatalf("an empty filter has bits %v set", got)
+	}
+}
+
+// A hasher simple enough to work out its positions by hand: the i-th hash is the length of the data plus 10*i
+type lengthHasher struct{}
+
+func (lengthHasher) Hash(data []byte, i int) int {
+	return len(data) + 10*i
+}
+
+func TestCustomHasher(t *testing.T) {
+	filter := NewBloomFilterWithHasher(25, 3, lengthHasher{})
+	// 3, 13 and 23, then 5, 15 and 0 once 25 wraps round to 0
+	filter.Set([]byte("abc")).Set([]byte("hello"))
+	if got, want := filter.SetBits(), []int{0, 3, 5, 13, 15, 23}; !slices.Equal(got, want) {
+		t.Fatalf("SetBits is %v, want %v", got, want)
+	}
+	// Anything else of the same length lands in the same place
+	if !filter.Test([]byte("xyz")) || filter.Test([]byte("four")) {
+		t.Fatal("Test doesn't use the hasher")
+	}
+}
+
+// Empty and one-byte keys are the smallest inputs a hasher can get, so they're the likeliest to trip up one that
+// reads past the end of the data. None of the filters should panic, and all of them should remember these keys
+func TestTinyKeys(t *testing.T) {
+	keys := [][]byte{nil, {}, {0}, {'a'}, {0xff}}
+	for _, hasher := range []Hasher{DefaultHasher{}, DefaultHasher{Seed: 1}, LegacyHasher{}, SHA256Hasher{}, SHA256Hasher{Key: []byte("k")}} {
+		filter := NewBloomFilterWithHasher(1000, 5, hasher)
+		filter.SetAll(keys)
+		checkNoFalseNegatives(t, filter, keys)
+	}
+
+	counting := NewCountingBloomFilter(1000, 3)
+	atomic := NewAtomicCountingBloomFilter(1000, 3)
+	deletable := NewDeletableBloomFilter(1000, 3)
+	partitioned := NewPartitionedBloomFilter(1000, 3)
+	scalable := NewScalableBloomFilter(100, 0.01)
+	rotating := NewRotatingBloomFilter(3, 1000, 3, 0)
+	hierarchical := NewHierarchicalBloomFilter(100, 2, 1000, 3)
+	for _, key := range keys {
+		counting.Set(key)
+		atomic.Set(key)
+		deletable.Set(key)
+		partitioned.Set(key)
+		scalable.Set(key)
+		rotating.Set(key)
+		hierarchical.Set(key)
+	}
+	for _, filter := range []interface{ Test([]byte) bool }{counting, atomic, deletable, partitioned, scalable, rotating, hierarchical} {
+		checkNoFalseNegatives(t, filter, keys)
+	}
+}
+
+// Run with `go test -fuzz FuzzGetPositions *.go` to keep trying new inputs. Whatever the data, size and k, every
+// position has to land inside the bit array, and the same data has to give the same positions again
+func FuzzGetPositions(f *testing.F) {
+	f.Add([]byte(""), 1, 1)
+	f.Add([]byte("hello"), 99, 2)
+	f.Add([]byte{0xff, 0x00, 0xff}, 63, 7)
+	f.Add(make([]byte, 1000), 1_000_000, 20)
+	f.Fuzz(func(t *testing.T, data []byte, size, k int) {
+		// Keep size and k positive and small enough to allocate
+		size = 1 + abs(size)%(1<<20)
+		k = 1 + abs(k)%32
+		for _, hasher := range []Hasher{DefaultHasher{}, LegacyHasher{}, SHA256Hasher{}} {
+			filter := NewBloomFilterWithHasher(size, k, hasher)
+			positions := filter.getPositions(data)
+			if len(positions) != k {
+				t.Fatalf("%T gave %d positions, want %d", hasher, len(positions), k)
+			}
+			for _, pos := range positions {
+				if pos < 0 || pos >= size {
+					t.Fatalf("%T gave position %d for a filter of size %d", hasher, pos, size)
+				}
+			}
+			if again := filter.getPositions(data); !slices.Equal(again, positions) {
+				t.Fatalf("%T gave %v and then %v for the same data", hasher, positions, again)
+			}
+			filter.Set(data)
+			if !filter.Test(data) {
+				t.Fatalf("%T: the data doesn't test positive after Set", hasher)
+			}
+		}
+	})
+}
+
+// math.MinInt is its own negative, so it gets moved up by one first
+func abs(n int) int {
+	if n < 0 {
+		return -(n + 1)
+	}
+	return n
+}
+
+func TestTestAnyAndTestAll(t *testing.T) {
+	filter, added := filledFilter(10_000, 5, 50)
+	// Keys that are definitely not there, rather than ones that might be false positives
+	var absent [][]byte
+	for _, key := range testKeys("absent-", 100) {
+		if !filter.Test(key) {
+			absent = append(absent, key)
+		}
+	}
+	mixed := [][]byte{absent[0], added[0], absent[1]}
+
+	cases := []struct {
+		name     string
+		items    [][]byte
+		any, all bool
+	}{
+		{"nothing", nil, false, true},
+		{"all added", added, true, true},
+		{"none added", absent, false, false},
+		{"some added", mixed, true, false},
+	}
+	for _, c := range cases {
+		if got := filter.TestAny(c.items); got != c.any {
+			t.Errorf("%s: TestAny is %v", c.name, got)
+		}
+		if got := filter.TestAll(c.items); got != c.all {
+			t.Errorf("%s: TestAll is %v", c.name, got)
+		}
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	a := NewBloomFilterWithK(100_000, 5).SetAll(testKeys("a-", 200))
+	if got := a.Similarity(a.Clone()); got != 1 {
+		t.Fatalf("identical filters have similarity %v", got)
+	}
+	if got := a.Similarity(NewBloomFilterWithK(100_000, 5).SetAll(testKeys("b-", 200))); got > 0.05 {
+		t.Fatalf("filters with nothing in common have similarity %v", got)
+	}
+
+	// Half of b is in a too, so the real Jaccard similarity is 100 / 300
+	b := NewBloomFilterWithK(100_000, 5).SetAll(testKeys("a-", 200)[100:]).SetAll(testKeys("c-", 100))
+	if got := a.Similarity(b); got < 0.3 || got > 0.37 {
+		t.Fatalf("filters sharing a third of their elements have similarity %v", got)
+	}
+	if got := a.Similarity(NewBloomFilterWithK(1000, 5)); got != 0 {
+		t.Fatalf("filters of different sizes have similarity %v", got)
+	}
+}
+
+func TestGobRoundTrip(t *testing.T) {
+	original, keys := filledFilter(2000, 4, 100)
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(original); err != nil {
+		t.Fatal(err)
+	}
+	var loaded BloomFilter
+	if err := gob.NewDecoder(&buf).Decode(&loaded); err != nil {
+		t.Fatal(err)
+	}
+	checkSameAnswers(t, original, &loaded, keys)
+}
+
+func TestArrayResize(t *testing.T) {
+	array := NewArrayWithBloomFilter()
+	array.DisableAutoResize()
+	keys := testKeys("key-", 200)
+	for _, key := range keys {
+		array.Set(string(key))
+	}
+	before := array.filter.Saturation()
+	array.Resize(10_000)
+	if array.filter.Size() != 10_000 {
+		t.Fatalf("the filter has size %d after Resize(10000)", array.filter.Size())
+	}
+	checkNoFalseNegatives(t, array.filter, keys)
+	if after := array.filter.Saturation(); after >= before {
+		t.Fatalf("saturation went from %v to %v", before, after)
+	}
+}
+
+func TestSetUnique(t *testing.T) {
+	for name, setUnique := range map[string]func(a *ArrayWithBloomFilter[string], value string){
+		"SetUnique":     (*ArrayWithBloomFilter[string]).SetUnique,
+		"SetUniqueFast": (*ArrayWithBloomFilter[string]).SetUniqueFast,
+	} {
+		array := NewArrayWithBloomFilter()
+		for _, word := range []string{"apple", "banana", "apple", "apple", "banana"} {
+			setUnique(array, word)
+		}
+		if !slices.Equal(array.array, []string{"apple", "banana"}) {
+			t.Errorf("%s left the array holding %v", name, array.array)
+		}
+	}
+
+	// The difference shows up with false positives. A tiny filter that can't grow says yes to nearly everything,
+	// so SetUniqueFast drops new values that SetUnique still adds
+	exact, fast := NewArrayWithBloomFilter(), NewArrayWithBloomFilter()
+	exact.filter, fast.filter = NewBloomFilterWithK(8, 1), NewBloomFilterWithK(8, 1)
+	exact.DisableAutoResize()
+	fast.DisableAutoResize()
+	for _, key := range testKeys("key-", 100) {
+		exact.SetUnique(string(key))
+		fast.SetUniqueFast(string(key))
+	}
+	if len(exact.array) != 100 {
+		t.Fatalf("SetUnique kept %d of 100 distinct values", len(exact.array))
+	}
+	if len(fast.array) >= 100 {
+		t.Fatal("SetUniqueFast kept every value, even with a full filter")
+	}
+}
+
+func TestGetters(t *testing.T) {
+	for _, c := range []struct{ size, k int }{{1, 1}, {64, 3}, {1000, 7}} {
+		filter := NewBloomFilterWithK(c.size, c.k)
+		if filter.Size() != c.size || filter.K() != c.k {
+			t.Errorf("NewBloomFilterWithK(%d, %d) has size %d and k %d", c.size, c.k, filter.Size(), filter.K())
+		}
+		frozen := filter.Frozen()
+		if frozen.Size() != c.size || frozen.K() != c.k {
+			t.Errorf("the frozen view of NewBloomFilterWithK(%d, %d) has size %d and k %d", c.size, c.k, frozen.Size(), frozen.K())
+		}
+	}
+	var zero BloomFilter
+	if zero.Size() != defaultSize || zero.K() != defaultK {
+		t.Errorf("the zero value has size %d and k %d", zero.Size(), zero.K())
+	}
+}
+
+func TestDeletable(t *testing.T) {
+	deletable := NewDeletableBloomFilter(1000, 3)
+	deletable.Set([]byte("apple")).Set([]byte("banana"))
+	if !deletable.Test([]byte("apple")) {
+		t.Fatal("apple doesn't test positive after Set")
+	}
+	deletable.Delete([]byte("apple"))
+	if deletable.Test([]byte("apple")) {
+		t.Fatal("apple still tests positive after Delete")
+	}
+	if !deletable.Test([]byte("banana")) {
+		t.Fatal("deleting apple also deleted banana")
+	}
+	// Tombstones are permanent, so adding it again doesn't bring it back
+	deletable.Set([]byte("apple"))
+	if deletable.Test([]byte("apple")) {
+		t.Fatal("apple came back after being deleted")
+	}
+}
+
+// Keys that differ in a single bit should land on unrelated positions, or an attacker could walk a key around the
+// filter one bit at a time. So the flipped keys shouldn't share any positions with the original, and between them
+// they should be spread over the whole array rather than bunched up near it
+func TestSHA256NearIdenticalKeys(t *testing.T) {
+	const size, k, buckets = 1_000_000, 5, 10
+	for _, hasher := range []Hasher{SHA256Hasher{}, SHA256Hasher{Key: []byte("secret")}} {
+		filter := NewBloomFilterWithHasher(size, k, hasher)
+		key := []byte("user-12345")
+		positions := filter.getPositions(key)
+		histogram := make([]int, buckets)
+		for bit := range 8 * len(key) {
+			flipped := append([]byte(nil), key...)
+			flipped[bit/8] ^= 1 << (bit % 8)
+			for i, pos := range filter.getPositions(flipped) {
+				if pos == positions[i] {
+					t.Errorf("%T: flipping bit %d left position %d where it was", hasher, bit, i)
+				}
+				histogram[pos*buckets/size]++
+			}
+		}
+		// 400 positions in 10 buckets is 40 each, give or take about 6
+		if lowest, highest := slices.Min(histogram), slices.Max(histogram); lowest < 20 || highest > 60 {
+			t.Errorf("%T: the flipped keys' positions are bunched up: %v", hasher, histogram)
+		}
+	}
+}
+
+func TestSetCounted(t *testing.T) {
+	filter := NewBloomFilterWithK(1_000_000, 7)
+	if got := filter.SetCounted([]byte("new")); got != 7 {
+		t.Fatalf("a new key in an empty filter changed %d bits, want 7", got)
+	}
+	if got := filter.SetCounted([]byte("new")); got != 0 {
+		t.Fatalf("adding the same key again changed %d bits, want 0", got)
+	}
+	// Adding the changes up gives the number of bits set
+	total := 7
+	for _, key := range testKeys("key-", 100) {
+		total += filter.SetCounted(key)
+	}
+	if total != filter.PopCount() {
+		t.Fatalf("SetCounted added up to %d, but %d bits are set", total, filter.PopCount())
+	}
+}
+
+// LegacyHasher adds up the bytes of a key, and short keys have small sums, so they all crowd into the first few
+// hundred positions. FNV spreads the same keys over the whole array
+func TestLegacyHasherClusters(t *testing.T) {
+	const buckets = 10
+	keys := testKeys("key-", 2000)
+	legacy := NewBloomFilterWithHasher(10_000, 2, LegacyHasher{}).SetAll(keys).DensityHistogram(buckets)
+	fnv := NewBloomFilterWithK(10_000, 2).SetAll(keys).DensityHistogram(buckets)
+
+	for i, count := range legacy[1:] {
+		if count != 0 {
+			t.Fatalf("LegacyHasher set %d bits in bucket %d, past the sums of short keys", count, i+1)
+		}
+	}
+	lowest, highest := slices.Min(fnv), slices.Max(fnv)
+	if float64(highest) > 1.2*float64(lowest) {
+		t.Fatalf("FNV buckets range from %d to %d set bits: %v", lowest, highest, fnv)
+	}
+}
+
+func TestTextRoundTrip(t *testing.T) {
+	original, keys := filledFilter(1000, 3, 50)
+	text, err := original.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(text), "m=1000,k=3:") {
+		t.Fatalf("the text form starts %.20s", text)
+	}
+	var loaded BloomFilter
+	if err := loaded.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	checkSameAnswers(t, original, &loaded, keys)
+}
+
+func TestUnmarshalTextBadInput(t *testing.T) {
+	text, err := NewBloomFilterWithK(1000, 3).MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, encoded, _ := strings.Cut(string(text), ":")
+	cases := map[string]string{
+		"no prefix":         encoded,
+		"bad prefix":        "size=1000:" + encoded,
+		"bad base64":        "m=1000,k=3:not*base64",
+		"wrong prefix":      "m=2000,k=3:" + encoded,
+		"not a filter":      "m=1000,k=3:aGVsbG8=",
+		"empty after colon": "m=1000,k=3:",
+	}
+	for name, bad := range cases {
+		var f BloomFilter
+		if err := f.UnmarshalText([]byte(bad)); err == nil {
+			t.Errorf("%s: UnmarshalText accepted %.40s", name, bad)
+		}
+	}
+}
+
+func TestDifference(t *testing.T) {
+	filter := NewBloomFilterWithK(100_000, 5).SetAll(testKeys("old-", 100))
+	baseline := filter.Clone()
+	filter.Set([]byte("new"))
+
+	diff, err := filter.Difference(baseline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// In a filter this empty, the new key's positions are very unlikely to have been set already
+	positions := filter.getPositions([]byte("new"))
+	slices.Sort(positions)
+	if got := diff.SetBits(); !slices.Equal(got, slices.Compact(positions)) {
+		t.Fatalf("the difference has bits %v, but the new key set %v", got, positions)
+	}
+
+	if diff, err := baseline.Difference(filter); err != nil || diff.PopCount() != 0 {
+		t.Fatalf("the baseline has %d bits the newer filter doesn't (%v)", diff.PopCount(), err)
+	}
+	if _, err := filter.Difference(NewBloomFilterWithK(100_000, 4)); err == nil {
+		t.Fatal("Difference accepted filters with different k")
+	}
+}
+
+// Long keys go through the same hash as short ones, so they should spread just as evenly, and keys that differ only
+// near the end shouldn't end up on the same positions
+func TestLongKeys(t *testing.T) {
+	for _, length := range []int{1 << 10, 64 << 10} {
+		t.Run(strconv.Itoa(length), func(t *testing.T) {
+			filter := NewBloomFilterWithK(10_000, 3)
+			keys := make([][]byte, 1000)
+			pairs := map[[2]int]bool{}
+			for i := range keys {
+				key := make([]byte, length)
+				copy(key[length-8:], strconv.Itoa(i))
+				keys[i] = key
+				positions := filter.getPositions(key)
+				pairs[[2]int{positions[0], positions[1]}] = true
+			}
+			filter.SetAll(keys)
+			checkNoFalseNegatives(t, filter, keys)
+			if len(pairs) < len(keys)-5 {
+				t.Fatalf("%d keys only have %d different first two positions", len(keys), len(pairs))
+			}
+			histogram := filter.DensityHistogram(10)
+			if lowest, highest := slices.Min(histogram), slices.Max(histogram); float64(highest) > 1.3*float64(lowest) {
+				t.Fatalf("buckets range from %d to %d set bits: %v", lowest, highest, histogram)
+			}
+		})
+	}
+}
+
+func TestPopCount(t *testing.T) {
+	cases := []struct {
+		name      string
+		size      int
+		positions []int
+	}{
+		{"empty", 100, nil},
+		{"one bit", 100, []int{42}},
+		{"word boundary", 200, []int{63, 64}},
+		{"whole first word", 128, func() []int {
+			var positions []int
+			for pos := range 64 {
+				positions = append(positions, pos)
+			}
+			return positions
+		}()},
+		{"every other bit", 1000, func() []int {
+			var positions []int
+			for pos := 0; pos < 1000; pos += 2 {
+				positions = append(positions, pos)
+			}
+			return positions
+		}()},
+	}
+	for _, c := range cases {
+		filter := NewBloomFilterWithK(c.size, 1)
+		for _, pos := range c.positions {
+			filter.setBit(pos)
+		}
+		if got := filter.PopCount(); got != len(c.positions) {
+			t.Errorf("%s: PopCount is %d, want %d", c.name, got, len(c.positions))
+		}
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	a := NewBloomFilterWithK(10_000, 5).WithNamespace([]byte("a"))
+	b := NewBloomFilterWithK(10_000, 5).WithNamespace([]byte("b"))
+	if slices.Equal(a.getPositions([]byte("bob")), b.getPositions([]byte("bob"))) {
+		t.Fatal("bob has the same positions in both namespaces")
+	}
+	a.Set([]byte("bob"))
+	if !a.Test([]byte("bob")) {
+		t.Fatal("bob doesn't test positive in its own namespace")
+	}
+	// Copying a's bits into b is what sharing one bit array between namespaces amounts to
+	copy(b.bits, a.bits)
+	if b.Test([]byte("bob")) {
+		t.Fatal("bob from namespace a tests positive in namespace b")
+	}
+	if _, err := a.Union(b); !errors.Is(err, ErrIncompatibleFilters) {
+		t.Fatalf("a union across namespaces gave %v", err)
+	}
+}
+
+func TestAddIfAbsent(t *testing.T) {
+	array := NewArrayWithBloomFilter()
+	if !array.AddIfAbsent("apple") {
+		t.Fatal("a new value wasn't reported as new")
+	}
+	if array.AddIfAbsent("apple") {
+		t.Fatal("a duplicate was reported as new")
+	}
+
+	// With a one-bit filter, everything after the first value is a false positive. They're still new, and the
+	// array finds that out
+	array = NewArrayWithBloomFilter()
+	array.filter = NewBloomFilterWithK(1, 1)
+	array.DisableAutoResize()
+	array.AddIfAbsent("apple")
+	if !array.filter.Test([]byte("banana")) {
+		t.Fatal("banana isn't a false positive, so this isn't testing anything")
+	}
+	if !array.AddIfAbsent("banana") || !slices.Equal(array.array, []string{"apple", "banana"}) {
+		t.Fatalf("a false positive wasn't added, the array holds %v", array.array)
+	}
+}
+
+// A context that's fine for the first few checks and cancelled from then on, so we can stop SetAllContext partway
+// through without racing a timer
+type cancelAfter struct {
+	context.Context
+	checks int
+}
+
+func (c *cancelAfter) Err() error {
+	if c.checks == 0 {
+		return context.Canceled
+	}
+	c.checks--
+	return nil
+}
+
+func TestSetAllContextCancelled(t *testing.T) {
+	keys := testKeys("key-", 5*contextChunk)
+	filter := NewBloomFilterWithK(100_000, 3)
+	added, err := filter.SetAllContext(&cancelAfter{Context: context.Background(), checks: 2}, keys)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+	if added != 2*contextChunk || filter.InsertCount() != added {
+		t.Fatalf("added %d keys with an InsertCount of %d, want %d", added, filter.InsertCount(), 2*contextChunk)
+	}
+	checkNoFalseNegatives(t, filter, keys[:added])
+
+	added, err = NewBloomFilterWithK(100_000, 3).SetAllContext(context.Background(), keys)
+	if err != nil || added != len(keys) {
+		t.Fatalf("with a context that's never cancelled, added %d of %d keys (%v)", added, len(keys), err)
+	}
+}
+
+func TestFrozenView(t *testing.T) {
+	filter := NewBloomFilterWithK(1000, 3).Set([]byte("apple"))
+	frozen := filter.Frozen()
+	if !frozen.Test([]byte("apple")) || frozen.Test([]byte("banana")) {
+		t.Fatal("the frozen view gives different answers to the filter")
+	}
+	if frozen.PopCount() != filter.PopCount() || frozen.Size() != 1000 || frozen.K() != 3 {
+		t.Fatal("the frozen view doesn't describe the filter")
+	}
+	// It's a view, not a copy
+	filter.Set([]byte("banana"))
+	if !frozen.Test([]byte("banana")) {
+		t.Fatal("the frozen view doesn't see changes to the filter")
+	}
+	if _, ok := any(frozen).(interface{ Set([]byte) *BloomFilter }); ok {
+		t.Fatal("the frozen view can be Set")
+	}
+}
+
+func TestInsertCount(t *testing.T) {
+	filter := NewBloomFilterWithK(1000, 3)
+	filter.Set([]byte("a")).Set([]byte("a")).SetAll(testKeys("key-", 10))
+	filter.SetString("b")
+	if got := filter.InsertCount(); got != 13 {
+		t.Fatalf("InsertCount is %d, want 13", got)
+	}
+
+	data, err := filter.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded BloomFilter
+	if err := loaded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.InsertCount(); got != 13 {
+		t.Fatalf("InsertCount is %d after a round trip, want 13", got)
+	}
+
+	filter.Reset()
+	if got := filter.InsertCount(); got != 0 {
+		t.Fatalf("InsertCount is %d after Reset", got)
+	}
+}
+
+func TestTestAndSet(t *testing.T) {
+	filter := NewBloomFilterWithK(1000, 3)
+	if filter.TestAndSet([]byte("apple")) {
+		t.Fatal("TestAndSet says a new key was already there")
+	}
+	if !filter.TestAndSet([]byte("apple")) {
+		t.Fatal("TestAndSet says a key it just added wasn't there")
+	}
+	if !filter.Test([]byte("apple")) || filter.InsertCount() != 2 {
+		t.Fatal("TestAndSet didn't add the key")
+	}
+}
+
+func TestFileRoundTrip(t *testing.T) {
+	original, keys := filledFilter(5000, 4, 200)
+	path := filepath.Join(t.TempDir(), "filter.bloom")
+	if err := original.SaveToFile(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameAnswers(t, original, loaded, keys)
+}
+
+func TestLoadFromFileBadInput(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.bloom")
+	if err := NewBloomFilterWithK(1000, 3).SaveToFile(good); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withVersion := func(version byte) []byte {
+		bad := append([]byte(nil), data...)
+		bad[len(fileMagic)] = version
+		return bad
+	}
+	cases := map[string][]byte{
+		"empty":         nil,
+		"bad magic":     append([]byte("NOPE"), data[len(fileMagic):]...),
+		"bad version":   withVersion(99),
+		"truncated":     data[:len(data)-3],
+		"only magic":    data[:len(fileMagic)],
+		"trailing data": append(append([]byte(nil), data...), 1, 2, 3),
+	}
+	for name, bad := range cases {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, bad, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadFromFile(path); err == nil {
+			t.Errorf("%s: LoadFromFile accepted it", name)
+		}
+	}
+	if _, err := LoadFromFile(filepath.Join(dir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("loading a missing file gave %v", err)
+	}
+}
+
+// Run with `go test -fuzz FuzzUnmarshalBinary *.go`. Anything UnmarshalBinary accepts has to be a filter that makes
+// sense (see Validate), and has to come out the same after marshalling it again. The seeds are one filter in each
+// of the two forms, so the fuzzer starts from data that gets past the header
+func FuzzUnmarshalBinary(f *testing.F) {
+	dense, _ := filledFilter(1000, 3, 100)
+	sparse, _ := filledFilter(10_000, 3, 20)
+	for _, filter := range []*BloomFilter{dense, sparse} {
+		data, err := filter.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var filter BloomFilter
+		if err := filter.UnmarshalBinary(data); err != nil {
+			return
+		}
+		if err := filter.Validate(); err != nil {
+			t.Fatalf("UnmarshalBinary accepted a broken filter: %v", err)
+		}
+		again, err := filter.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reloaded BloomFilter
+		if err := reloaded.UnmarshalBinary(again); err != nil {
+			t.Fatalf("can't load a filter we just marshalled: %v", err)
+		}
+		if !reloaded.Equals(&filter) || reloaded.InsertCount() != filter.InsertCount() {
+			t.Fatal("marshalling and unmarshalling again changed the filter")
+		}
+	})
+}
+
+// The fuzz seeds are only worth having if they really are one of each form
+func TestFuzzSeedForms(t *testing.T) {
+	dense, _ := filledFilter(1000, 3, 100)
+	sparse, _ := filledFilter(10_000, 3, 20)
+	for filter, flag := range map[*BloomFilter]byte{dense: denseFlag, sparse: sparseFlag} {
+		data, _ := filter.MarshalBinary()
+		if data[25] != flag {
+			t.Errorf("a filter of size %d with %d bits set has flag %d, want %d", filter.Size(), filter.PopCount(), data[25], flag)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	defaults := NewBloomFilter()
+	if defaults.Size() != defaultSize || defaults.K() != defaultK || defaults.hasherOrDefault() != (Hasher(DefaultHasher{})) {
+		t.Fatalf("NewBloomFilter() gave size %d, k %d, hasher %T", defaults.Size(), defaults.K(), defaults.hasherOrDefault())
+	}
+	if defaults.mu != nil || defaults.instrumented || defaults.logInserts || defaults.namespace != nil || defaults.normalize != nil {
+		t.Fatal("NewBloomFilter() turned on an optional feature")
+	}
+
+	key := []byte("Key")
+	filter := NewBloomFilter(
+		WithSize(5000),
+		WithK(6),
+		WithHasher(SHA256Hasher{}),
+		WithNamespace([]byte("ns")),
+		WithNormalizer(ToLowerNormalizer),
+		WithConcurrency(),
+		WithInstrumentation(),
+		WithInsertionLog(),
+	)
+	if filter.Size() != 5000 || filter.K() != 6 {
+		t.Fatalf("got size %d and k %d", filter.Size(), filter.K())
+	}
+	want := hashPositions(SHA256Hasher{}, []byte("nskey"), 5000, 6)
+	if got := filter.getPositions(key); !slices.Equal(got, want) {
+		t.Fatalf("positions are %v, want %v with the hasher, namespace and normalizer all applied", got, want)
+	}
+	filter.Set(key)
+	if filter.mu == nil || len(filter.touches) != 5000 || len(filter.InsertedKeys()) != 1 {
+		t.Fatal("WithConcurrency, WithInstrumentation or WithInsertionLog didn't take effect")
+	}
+
+	// Options are applied in order, so a later one wins
+	if got := NewBloomFilter(WithK(3), WithK(4)).K(); got != 4 {
+		t.Fatalf("k is %d, want the later option's 4", got)
+	}
+}
+
+func TestMergeBytesMatchesUnion(t *testing.T) {
+	// The second filter is empty enough to be written in the sparse form, and the third isn't
+	base := NewBloomFilterWithK(10_000, 3).SetAll(testKeys("base-", 500))
+	for _, other := range []*BloomFilter{
+		NewBloomFilterWithK(10_000, 3).SetAll(testKeys("few-", 20)),
+		NewBloomFilterWithK(10_000, 3).SetAll(testKeys("many-", 1000)),
+	} {
+		data, err := other.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		union, err := base.Union(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		merged := base.Clone()
+		if err := merged.MergeBytes(data); err != nil {
+			t.Fatal(err)
+		}
+		if !merged.Equals(union) || merged.InsertCount() != union.InsertCount() {
+			t.Fatalf("MergeBytes of a form-%d filter doesn't match Union", data[25])
+		}
+	}
+
+	data, _ := NewBloomFilterWithK(20_000, 3).MarshalBinary()
+	merged := base.Clone()
+	if err := merged.MergeBytes(data); !errors.Is(err, ErrIncompatibleFilters) {
+		t.Fatalf("merging a filter of a different size gave %v", err)
+	}
+	if !merged.Equals(base) || merged.InsertCount() != base.InsertCount() {
+		t.Fatal("a failed merge changed the filter")
+	}
+}
+
+func TestArrayAutoResize(t *testing.T) {
+	array := NewArrayWithBloomFilter()
+	keys := testKeys("key-", 2000)
+	for _, key := range keys {
+		array.Set(string(key))
+	}
+	if array.filter.Size() <= defaultSize {
+		t.Fatalf("the filter is still size %d after 2000 values", array.filter.Size())
+	}
+	if saturation := array.filter.Saturation(); saturation >= defaultResizeThreshold {
+		t.Fatalf("saturation is %v, at or past the resize threshold", saturation)
+	}
+	if array.setBits != array.filter.PopCount() {
+		t.Fatalf("the array thinks %d bits are set, but %d are", array.setBits, array.filter.PopCount())
+	}
+	checkNoFalseNegatives(t, array.filter, keys)
+
+	// Without auto-resizing the filter just fills up
+	fixed := NewArrayWithBloomFilter()
+	fixed.DisableAutoResize()
+	for _, key := range keys {
+		fixed.Set(string(key))
+	}
+	if fixed.filter.Size() != defaultSize || !fixed.filter.IsSaturated(0.99) {
+		t.Fatalf("with auto-resizing off, the filter has size %d and saturation %v", fixed.filter.Size(), fixed.filter.Saturation())
+	}
+}
+
+func TestSeeds(t *testing.T) {
+	key := []byte("key")
+	same1, same2 := NewBloomFilterSeeded(10_000, 5, 42), NewBloomFilterSeeded(10_000, 5, 42)
+	if !slices.Equal(same1.getPositions(key), same2.getPositions(key)) {
+		t.Fatal("filters with the same seed put the same key in different places")
+	}
+	other := NewBloomFilterSeeded(10_000, 5, 43)
+	if slices.Equal(same1.getPositions(key), other.getPositions(key)) {
+		t.Fatal("filters with different seeds put the key in the same places")
+	}
+	// A seed of 0 is no seed at all
+	if !slices.Equal(NewBloomFilterSeeded(10_000, 5, 0).getPositions(key), NewBloomFilterWithK(10_000, 5).getPositions(key)) {
+		t.Fatal("seed 0 isn't the same as no seed")
+	}
+	if _, err := same1.Union(other); !errors.Is(err, ErrIncompatibleFilters) {
+		t.Fatalf("a union of filters with different seeds gave %v", err)
+	}
+}
+
+func TestRecommendedK(t *testing.T) {
+	// An empty filter has nothing to go on, so it keeps its k
+	if got := NewBloomFilterWithK(1000, 2).RecommendedK(); got != 2 {
+		t.Fatalf("an empty filter recommends k = %d, want 2", got)
+	}
+
+	// With X of 1000 bits set and k = 2, ApproxCount is n = -(1000/2) * ln(1 - X/1000), and the best k for that many
+	// elements is (1000/n) * ln 2. For 200 bits that's n = 111.6, rounded to 112, and k = 6.19. For 500 bits it's
+	// n = 346.6, rounded to 347, and k = 2.00. For 900 bits it's n = 1151.3, rounded to 1151, and k = 0.60, which
+	// rounds to 1
+	for _, c := range []struct{ set, want int }{{200, 6}, {500, 2}, {900, 1}} {
+		filter := NewBloomFilterWithK(1000, 2)
+		for pos := range c.set {
+			filter.setBit(pos)
+		}
+		if got := filter.RecommendedK(); got != c.want {
+			t.Errorf("with %d bits set, RecommendedK is %d, want %d", c.set, got, c.want)
+		}
+		if filter.PopCount() != c.set {
+			t.Error("RecommendedK changed the filter")
+		}
+	}
+}
+
+func TestDedupLines(t *testing.T) {
+	var input strings.Builder
+	for i := range 5000 {
+		fmt.Fprintf(&input, "line %d\n", i%50)
+	}
+	var want strings.Builder
+	for i := range 50 {
+		fmt.Fprintf(&want, "line %d\n", i)
+	}
+	for name, dedup := range map[string]func(io.Reader, io.Writer, int, int) (int, error){
+		"DedupLines":      DedupLines,
+		"DedupLinesExact": DedupLinesExact,
+	} {
+		var out strings.Builder
+		written, err := dedup(strings.NewReader(input.String()), &out, 10_000, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if written != 50 || out.String() != want.String() {
+			t.Errorf("%s wrote %d lines:\n%s", name, written, out.String())
+		}
+	}
+
+	// A filter far too small for the input drops new lines, unless we check them
+	var long strings.Builder
+	for i := range 500 {
+		fmt.Fprintf(&long, "line %d\n", i)
+	}
+	if written, _ := DedupLines(strings.NewReader(long.String()), io.Discard, 100, 2); written == 500 {
+		t.Error("DedupLines with a full filter didn't drop anything")
+	}
+	if written, _ := DedupLinesExact(strings.NewReader(long.String()), io.Discard, 100, 2); written != 500 {
+		t.Errorf("DedupLinesExact dropped %d unique lines", 500-written)
+	}
+}
+
+func TestUnionAll(t *testing.T) {
+	if _, err := UnionAll(); err == nil {
+		t.Fatal("UnionAll of nothing didn't give an error")
+	}
+
+	for _, n := range []int{1, 3, 50} {
+		filters := make([]*BloomFilter, n)
+		want := NewBloomFilterWithK(10_000, 4)
+		for i := range filters {
+			keys := testKeys(strconv.Itoa(i)+"-", 20)
+			filters[i] = NewBloomFilterWithK(10_000, 4).SetAll(keys)
+			want.SetAll(keys)
+		}
+		union, err := UnionAll(filters...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !union.Equals(want) || union.InsertCount() != want.InsertCount() {
+			t.Errorf("UnionAll of %d filters isn't the filter with all their keys", n)
+		}
+		if union == filters[0] {
+			t.Error("UnionAll handed back its first argument rather than a new filter")
+		}
+	}
+
+	a, b := NewBloomFilterWithK(1000, 4), NewBloomFilterWithK(1000, 5)
+	if _, err := UnionAll(a, a, b); !errors.Is(err, ErrIncompatibleFilters) {
+		t.Fatalf("UnionAll of incompatible filters gave %v", err)
+	}
+}
+
+func TestCollisionReport(t *testing.T) {
+	// See lengthHasher: "abc" and "xyz" both land on 3, 13 and 23, and "hello" on 5, 15 and 0
+	filter := NewBloomFilter(WithSize(25), WithK(3), WithHasher(lengthHasher{}), WithInstrumentation())
+	filter.Set([]byte("abc")).Set([]byte("xyz")).Set([]byte("hello"))
+	want := map[int]int{3: 2, 13: 2, 23: 2, 5: 1, 15: 1, 0: 1}
+	if got := filter.CollisionReport(); !maps.Equal(got, want) {
+		t.Fatalf("CollisionReport is %v, want %v", got, want)
+	}
+
+	// An element whose positions coincide only counts once
+	single := NewBloomFilter(WithSize(10), WithK(3), WithHasher(lengthHasher{}), WithInstrumentation())
+	single.Set([]byte("a"))
+	if got := single.CollisionReport(); !maps.Equal(got, map[int]int{1: 1}) {
+		t.Fatalf("CollisionReport is %v, want map[1:1]", got)
+	}
+
+	if report := NewBloomFilterWithK(100, 2).Set([]byte("a")).CollisionReport(); report != nil {
+		t.Fatalf("a filter without instrumentation gave %v", report)
+	}
+}
+
+func TestNewFromElements(t *testing.T) {
+	items := testKeys("item-", 1000)
+	filter := NewFromElements(items, 0.01)
+	m, k := OptimalParameters(1000, 0.01)
+	if filter.Size() != m || filter.K() != k || filter.InsertCount() != 1000 {
+		t.Fatalf("got size %d, k %d, %d inserts, want %d, %d, 1000", filter.Size(), filter.K(), filter.InsertCount(), m, k)
+	}
+	checkNoFalseNegatives(t, filter, items)
+	if rate := positiveRate(filter, testKeys("other-", 20_000)); rate > 0.013 {
+		t.Fatalf("false-positive rate is %v", rate)
+	}
+
+	if empty := NewFromElements(nil, 0.01); empty.PopCount() != 0 || empty.Size() < 1 {
+		t.Fatal("NewFromElements of nothing isn't an empty filter")
+	}
+}
+
+func TestSetStringMatchesSet(t *testing.T) {
+	byString := NewBloomFilterWithK(1000, 3).SetString("apple").SetString("")
+	byBytes := NewBloomFilterWithK(1000, 3).Set([]byte("apple")).Set([]byte(""))
+	if !byString.Equals(byBytes) {
+		t.Fatal("SetString and Set add different elements")
+	}
+	if !byBytes.TestString("apple") || !byString.Test([]byte("apple")) || byString.TestString("banana") {
+		t.Fatal("TestString and Test give different answers")
+	}
+}
+
+func TestMemoryBytes(t *testing.T) {
+	cases := []struct{ size, want int }{
+		{1, 8},
+		{64, 8},
+		{65, 16},
+		{1_000_000, 125_000},
+	}
+	for _, c := range cases {
+		if got := NewBloomFilterWithK(c.size, 3).MemoryBytes(); got != c.want {
+			t.Errorf("a filter of %d bits takes %d bytes, want %d", c.size, got, c.want)
+		}
+	}
+	// A counting filter has a byte per position instead of a bit
+	if got := NewCountingBloomFilter(1_000_000, 3).MemoryBytes(); got != 1_000_000 {
+		t.Errorf("a counting filter of a million positions takes %d bytes", got)
+	}
+}
+
+func TestConsumeScanner(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("the quick  brown\nfox\tjumps "))
+	scanner.Split(bufio.ScanWords)
+	filter := NewBloomFilterWithK(1000, 3)
+	added, err := filter.ConsumeScanner(scanner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	words := [][]byte{[]byte("the"), []byte("quick"), []byte("brown"), []byte("fox"), []byte("jumps")}
+	if added != len(words) || filter.InsertCount() != len(words) {
+		t.Fatalf("added %d words, want %d", added, len(words))
+	}
+	checkNoFalseNegatives(t, filter, words)
+	if filter.Test([]byte("quick  brown")) || filter.Test([]byte("fox\tjumps")) {
+		t.Fatal("ConsumeScanner added whole lines instead of words")
+	}
+}
+
+func TestIncompatibleFiltersError(t *testing.T) {
+	filter := NewBloomFilterWithK(1000, 3)
+	for name, other := range map[string]*BloomFilter{
+		"size": NewBloomFilterWithK(2000, 3),
+		"k":    NewBloomFilterWithK(1000, 4),
+	} {
+		operations := map[string]func() error{
+			"Union":       func() error { _, err := filter.Union(other); return err },
+			"Intersect":   func() error { _, err := filter.Intersect(other); return err },
+			"Difference":  func() error { _, err := filter.Difference(other); return err },
+			"CompareBits": func() error { _, _, _, err := filter.CompareBits(other); return err },
+			"UnionAll":    func() error { _, err := UnionAll(filter, other); return err },
+		}
+		for operation, run := range operations {
+			if err := run(); !errors.Is(err, ErrIncompatibleFilters) {
+				t.Errorf("%s of filters with different %s gave %v", operation, name, err)
+			}
+		}
+	}
+
+	if err := NewCountingBloomFilter(1000, 3).Add(NewCountingBloomFilter(1000, 4)); !errors.Is(err, ErrIncompatibleFilters) {
+		t.Errorf("adding counting filters with different k gave %v", err)
+	}
+}
+
+func TestSparseEncoding(t *testing.T) {
+	sparse, keys := filledFilter(100_000, 3, 100)
+	data, err := sparse.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dense := binaryHeaderLen + 8*wordsFor(sparse.Size())
+	if data[25] != sparseFlag || len(data) > dense/10 {
+		t.Fatalf("a filter with %d of %d bits set takes %d bytes with flag %d, against %d dense",
+			sparse.PopCount(), sparse.Size(), len(data), data[25], dense)
+	}
+
+	// Each way of reading it back gives the same filter
+	var unmarshalled, read BloomFilter
+	if err := unmarshalled.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := read.ReadFrom(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	checkSameAnswers(t, sparse, &unmarshalled, keys)
+	checkSameAnswers(t, sparse, &read, keys)
+	if !unmarshalled.Equals(sparse) || !read.Equals(sparse) {
+		t.Fatal("the sparse form doesn't load back as the same bits")
+	}
+
+	// A full filter stays dense
+	full, _ := filledFilter(1000, 3, 1000)
+	if data, _ := full.MarshalBinary(); data[25] != denseFlag {
+		t.Fatal("a full filter was written in the sparse form")
+	}
+}
+
+func TestSparseBadInput(t *testing.T) {
+	// Only the size is written by hand, since a filter of size 1<<40 is too big to make just for its header
+	header := func(size int) []byte {
+		data := make([]byte, binaryHeaderLen)
+		NewBloomFilterWithK(64, 3).putHeader(data, true)
+		binary.BigEndian.PutUint64(data[1:], uint64(size))
+		return data
+	}
+	cases := map[string][]byte{
+		"no count":        header(640),
+		"missing gaps":    append(header(640), 3, 0),
+		"past the end":    append(header(640), 1, 0xff, 0x05),
+		"too many bits":   append(header(64), 65),
+		"huge, no bits":   append(header(1<<40), 0),
+		"bad varint":      append(header(640), 1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff),
+		"count too large": append(header(640), 0xff, 0xff, 0xff, 0xff, 0x0f),
+	}
+	for name, bad := range cases {
+		var unmarshalled, read BloomFilter
+		if err := unmarshalled.UnmarshalBinary(bad); err == nil {
+			t.Errorf("%s: UnmarshalBinary accepted it", name)
+		}
+		if _, err := read.ReadFrom(bytes.NewReader(bad)); err == nil {
+			t.Errorf("%s: ReadFrom accepted it", name)
+		}
+	}
+	// ReadFrom stops at the end of the filter, since a stream can have more after it, but UnmarshalBinary is given
+	// exactly one filter
+	var f BloomFilter
+	if err := f.UnmarshalBinary(append(header(640), 1, 0, 0)); err == nil {
+		t.Error("UnmarshalBinary accepted trailing bytes")
+	}
+}
+
+func TestBitsPerElement(t *testing.T) {
+	if got := NewBloomFilterWithK(1000, 2).BitsPerElement(); !math.IsInf(got, 1) {
+		t.Fatalf("an empty filter has %v bits per element, want +Inf", got)
+	}
+
+	// With X of 1000 bits set and k = 2, ApproxCount is -(1000/2) * ln(1 - X/1000): 112 for 200 bits, 347 for 500 and
+	// 1151 for 900. Every bit set counts as 999 of them (see estimateCount), which comes out as 3454
+	for _, c := range []struct{ set, count int }{{200, 112}, {500, 347}, {900, 1151}, {1000, 3454}} {
+		filter := NewBloomFilterWithK(1000, 2)
+		for pos := range c.set {
+			filter.setBit(pos)
+		}
+		if got, want := filter.BitsPerElement(), 1000/float64(c.count); math.Abs(got-want) > 1e-9 {
+			t.Errorf("with %d bits set, BitsPerElement is %v, want %v", c.set, got, want)
+		}
+	}
+}
+
+func TestRotatingForgets(t *testing.T) {
+	rotating := NewRotatingBloomFilter(3, 1000, 3, 0)
+	rotating.Set([]byte("old"))
+	rotating.Rotate()
+	rotating.Set([]byte("new"))
+	rotating.Rotate()
+	if !rotating.Test([]byte("old")) || !rotating.Test([]byte("new")) {
+		t.Fatal("keys were forgotten while their windows were still kept")
+	}
+	rotating.Rotate()
+	if rotating.Test([]byte("old")) {
+		t.Fatal("old is still there three rotations after it was added")
+	}
+	if !rotating.Test([]byte("new")) {
+		t.Fatal("new was forgotten too early")
+	}
+	rotating.Rotate()
+	if rotating.Test([]byte("new")) {
+		t.Fatal("new is still there three rotations after it was added")
+	}
+}
+
+// With an interval, windows rotate on their own. Instead of waiting, move the start of the window back
+func TestRotatingInterval(t *testing.T) {
+	rotating := NewRotatingBloomFilter(2, 1000, 3, time.Hour)
+	rotating.Set([]byte("key"))
+	if !rotating.Test([]byte("key")) {
+		t.Fatal("key was forgotten straight away")
+	}
+	rotating.started = rotating.started.Add(-90 * time.Minute)
+	if !rotating.Test([]byte("key")) {
+		t.Fatal("key was forgotten after one window")
+	}
+	rotating.started = rotating.started.Add(-time.Hour)
+	if rotating.Test([]byte("key")) {
+		t.Fatal("key is still there after two windows")
+	}
+}
+
+func TestNormalizer(t *testing.T) {
+	filter := NewBloomFilter(WithSize(1000), WithK(3), WithNormalizer(ToLowerNormalizer))
+	filter.Set([]byte("abc"))
+	if !filter.Test([]byte("ABC")) || !filter.Test([]byte("aBc")) {
+		t.Fatal("a normalized filter tells cases apart")
+	}
+	filter.SetString("HELLO")
+	if !filter.TestString("hello") {
+		t.Fatal("SetString skips the normalizer")
+	}
+	if NewBloomFilterWithK(1000, 3).Set([]byte("abc")).Test([]byte("ABC")) {
+		t.Fatal("a filter without a normalizer ignores case")
+	}
+
+	// The normalizer mustn't change the caller's data
+	key := []byte("MiXeD")
+	filter.Set(key)
+	if string(key) != "MiXeD" {
+		t.Fatalf("Set changed the key to %q", key)
+	}
+}
+
+func TestBitsRawRoundTrip(t *testing.T) {
+	original, keys := filledFilter(1000, 3, 50)
+	words := original.Bits()
+	if len(words) != wordsFor(1000) {
+		t.Fatalf("Bits gave %d words for 1000 bits", len(words))
+	}
+	words[0] ^= 1
+	if original.Bits()[0] == words[0] {
+		t.Fatal("Bits doesn't return a copy")
+	}
+	words[0] ^= 1
+
+	var loaded BloomFilter
+	if err := loaded.SetBitsRaw(words, 1000, 3); err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equals(original) || loaded.InsertCount() != 0 {
+		t.Fatal("SetBitsRaw didn't give back the same filter")
+	}
+	checkNoFalseNegatives(t, &loaded, keys)
+
+	spare := append([]uint64(nil), words...)
+	spare[len(spare)-1] |= 1 << 63
+	for name, err := range map[string]error{
+		"too few words":  loaded.SetBitsRaw(words[1:], 1000, 3),
+		"too many words": loaded.SetBitsRaw(append(words, 0), 1000, 3),
+		"spare bits":     loaded.SetBitsRaw(spare, 1000, 3),
+		"zero k":         loaded.SetBitsRaw(words, 1000, 0),
+	} {
+		if err == nil {
+			t.Errorf("%s: SetBitsRaw accepted it", name)
+		}
+	}
+}
+
+func TestEstimateUnionCardinality(t *testing.T) {
+	// The second and third filters share half their keys, which should only count once
+	filters := []*BloomFilter{
+		NewBloomFilterWithK(100_000, 5).SetAll(testKeys("a-", 1000)),
+		NewBloomFilterWithK(100_000, 5).SetAll(testKeys("b-", 1000)),
+		NewBloomFilterWithK(100_000, 5).SetAll(testKeys("b-", 2000)[500:1500]),
+	}
+	union, err := UnionAll(filters...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := EstimateUnionCardinality(filters...), union.ApproxCount(); got != want {
+		t.Fatalf("EstimateUnionCardinality is %d, but the union's ApproxCount is %d", got, want)
+	}
+	if got := EstimateUnionCardinality(filters...); got < 2400 || got > 2600 {
+		t.Fatalf("EstimateUnionCardinality is %d for 2500 distinct keys", got)
+	}
+	if got := EstimateUnionCardinality(); got != 0 {
+		t.Fatalf("EstimateUnionCardinality of nothing is %d", got)
+	}
+}
+
+func TestArrayEach(t *testing.T) {
+	array := NewArrayWithBloomFilter()
+	for _, word := range []string{"apple", "banana", "cherry"} {
+		array.Set(word)
+	}
+	var seen []string
+	array.Each(func(value string) bool {
+		seen = append(seen, value)
+		return true
+	})
+	if !slices.Equal(seen, []string{"apple", "banana", "cherry"}) {
+		t.Fatalf("Each visited %v", seen)
+	}
+
+	seen = nil
+	array.Each(func(value string) bool {
+		seen = append(seen, value)
+		return value != "banana"
+	})
+	if !slices.Equal(seen, []string{"apple", "banana"}) {
+		t.Fatalf("Each didn't stop after banana, it visited %v", seen)
+	}
+}
+
+func TestFalsePositiveTable(t *testing.T) {
+	for _, c := range []struct{ m, n int }{{10_000, 1000}, {9_585_059, 1_000_000}, {1000, 500}} {
+		table := FalsePositiveTable(c.m, c.n, 20)
+		if len(table) != 20 {
+			t.Fatalf("the table has %d entries, want 20", len(table))
+		}
+		best := 1
+		for k, rate := range table {
+			if rate < table[best] {
+				best = k
+			}
+		}
+		// The best whole k is one of the two either side of (m/n) * ln 2
+		optimal := float64(c.m) / float64(c.n) * math.Ln2
+		if math.Abs(float64(best)-optimal) >= 1 {
+			t.Errorf("for m = %d and n = %d the lowest rate is at k = %d, but the optimum is %.2f", c.m, c.n, best, optimal)
+		}
+	}
+}
+
+// An ID type that prints itself, like plenty of real ones do
+type testUserID int
+
+func (id testUserID) String() string {
+	return "user:" + strconv.Itoa(int(id))
+}
+
+func TestStringer(t *testing.T) {
+	filter := NewBloomFilterWithK(1000, 3)
+	filter.SetStringer(testUserID(42))
+	if !filter.TestStringer(testUserID(42)) || filter.TestStringer(testUserID(43)) {
+		t.Fatal("TestStringer doesn't find what SetStringer added")
+	}
+	// It's the printed form that counts
+	if !filter.TestString("user:42") {
+		t.Fatal("SetStringer didn't add the String form")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	var zero BloomFilter
+	if err := zero.Validate(); err != nil {
+		t.Fatalf("a zero-value filter fails Validate: %v", err)
+	}
+	good := NewBloomFilter(WithSize(100), WithK(3), WithInstrumentation()).Set([]byte("x"))
+	if err := good.Validate(); err != nil {
+		t.Fatalf("a healthy filter fails Validate: %v", err)
+	}
+
+	corruptions := map[string]func(f *BloomFilter){
+		"negative size":   func(f *BloomFilter) { f.size = -1 },
+		"too few words":   func(f *BloomFilter) { f.bits = f.bits[:1] },
+		"too many words":  func(f *BloomFilter) { f.bits = append(f.bits, 0) },
+		"spare bits set":  func(f *BloomFilter) { f.bits[len(f.bits)-1] |= 1 << 63 },
+		"zero k":          func(f *BloomFilter) { f.k = 0 },
+		"k past the size": func(f *BloomFilter) { f.k = 101 },
+		"negative count":  func(f *BloomFilter) { f.insertCount = -1 },
+		"seed, no hasher": func(f *BloomFilter) { f.seed = 7 },
+		"wrong seed":      func(f *BloomFilter) { f.seed, f.hasher = 7, DefaultHasher{Seed: 8} },
+		"lost counters":   func(f *BloomFilter) { f.touches = nil },
+	}
+	for name, corrupt := range corruptions {
+		f := good.Clone()
+		corrupt(f)
+		if err := f.Validate(); err == nil {
+			t.Errorf("%s: Validate didn't notice", name)
+		}
+	}
+
+	// A seed that matches its hasher is fine
+	if err := NewBloomFilterSeeded(100, 3, 7).Validate(); err != nil {
+		t.Errorf("a seeded filter fails Validate: %v", err)
+	}
+}
+
+func TestInsertionLog(t *testing.T) {
+	if keys := NewBloomFilterWithK(1000, 3).Set([]byte("a")).InsertedKeys(); keys != nil {
+		t.Fatalf("a filter without the log gave %q", keys)
+	}
+
+	filter := NewBloomFilter(WithSize(1000), WithInsertionLog())
+	if keys := filter.InsertedKeys(); len(keys) != 0 {
+		t.Fatalf("a new filter has logged %q", keys)
+	}
+	key := []byte("b")
+	filter.Set([]byte("a")).Set(key).SetString("c").Set([]byte("a"))
+	key[0] = 'z'
+	want := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("a")}
+	got := filter.InsertedKeys()
+	if !slices.EqualFunc(got, want, bytes.Equal) {
+		t.Fatalf("InsertedKeys is %q, want %q", got, want)
+	}
+	got[0][0] = 'z'
+	if filter.InsertedKeys()[0][0] != 'a' {
+		t.Fatal("changing what InsertedKeys returned changed the log")
+	}
+
+	filter.Reset()
+	if keys := filter.InsertedKeys(); len(keys) != 0 {
+		t.Fatalf("after Reset the log still has %q", keys)
+	}
+}
+
+func TestHierarchical(t *testing.T) {
+	hierarchical := NewHierarchicalBloomFilter(1000, 2, 20_000, 7)
+	fine := NewBloomFilterWithK(20_000, 7)
+	added := testKeys("in-", 1000)
+	for _, key := range added {
+		hierarchical.Set(key)
+		fine.Set(key)
+	}
+	checkNoFalseNegatives(t, hierarchical, added)
+
+	// A positive needs both filters to agree, so it can't be more likely than a positive from the fine one alone
+	absent := testKeys("out-", 20_000)
+	for _, key := range absent {
+		if hierarchical.Test(key) && !fine.Test(key) {
+			t.Fatalf("%q tests positive, but not in the fine filter on its own", key)
+		}
+	}
+	if rate, fineRate := positiveRate(hierarchical, absent), positiveRate(fine, absent); rate > fineRate {
+		t.Fatalf("false-positive rate is %v, worse than the fine filter's %v", rate, fineRate)
+	}
+}
+
+func TestUint64Keys(t *testing.T) {
+	filter := NewBloomFilterWithK(1000, 3).SetUint64(42)
+	want := NewBloomFilterWithK(1000, 3).Set([]byte{0, 0, 0, 0, 0, 0, 0, 42})
+	if !filter.Equals(want) {
+		t.Fatal("SetUint64(42) isn't the same as adding its 8 big-endian bytes")
+	}
+	if !filter.TestUint64(42) || filter.TestUint64(43) {
+		t.Fatal("TestUint64 doesn't find what SetUint64 added")
+	}
+	// Other ways of writing the number are different elements
+	if filter.TestString("42") || filter.Test(binary.LittleEndian.AppendUint64(nil, 42)) {
+		t.Fatal("42 written another way tests positive")
+	}
+}
+
+// Adding up 4MB of 0xff bytes without taking remainders as we go would overflow a 32-bit int. 0xff >> 1 is 127 and
+// 0xff >> 2 is 63, so the sums come out as 127 and 63 times the length, and the positions are those modulo the size
+func TestLegacyHasherLongInput(t *testing.T) {
+	const length = 4 << 20
+	data := bytes.Repeat([]byte{0xff}, length)
+	for _, size := range []int{1000, 999_983, 1 << 30} {
+		filter := NewBloomFilterWithHasher(size, 4, LegacyHasher{})
+		positions := filter.getPositions(data)
+		want := []int{127 * length % size, 63 * length % size, 127 * length % size, 63 * length % size}
+		if !slices.Equal(positions, want) {
+			t.Errorf("positions are %v for size %d, want %v", positions, size, want)
+		}
+	}
+	// Hash without a size still stays positive
+	if h := (LegacyHasher{}).Hash(data, 0); h != 127*length {
+		t.Errorf("Hash is %d, want %d", h, 127*length)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	filter := NewBloomFilterWithK(1000, 3).Set([]byte("apple"))
+	if got := filter.Classify([]byte("apple")); got != ProbablyPresent {
+		t.Errorf("an added key is %v", got)
+	}
+	if got := filter.Classify([]byte("banana")); got != DefinitelyNotPresent {
+		t.Errorf("a key that was never added is %v", got)
+	}
+
+	// The array checks the positives, so even a false positive gets a definite answer
+	array := NewArrayWithBloomFilter()
+	array.filter = NewBloomFilterWithK(1, 1)
+	array.DisableAutoResize()
+	array.Set("apple")
+	if got := array.Classify("apple"); got != DefinitelyPresent {
+		t.Errorf("a value in the array is %v", got)
+	}
+	if got := array.Classify("banana"); got != DefinitelyNotPresent {
+		t.Errorf("a false positive is %v", got)
+	}
+
+	for membership, want := range map[Membership]string{
+		DefinitelyNotPresent: "definitely not present",
+		ProbablyPresent:      "probably present",
+		DefinitelyPresent:    "definitely present",
+		Membership(99):       "unknown membership",
+	} {
+		if got := membership.String(); got != want {
+			t.Errorf("Membership(%d) prints as %q, want %q", int(membership), got, want)
+		}
+	}
+}
+
+func TestCountingAdd(t *testing.T) {
+	a, b := NewCountingBloomFilter(1000, 3), NewCountingBloomFilter(1000, 3)
+	a.Set([]byte("apple")).Set([]byte("apple"))
+	b.Set([]byte("apple")).Set([]byte("banana"))
+	if err := a.Add(b); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.Frequency([]byte("apple")); got < 3 {
+		t.Fatalf("apple has frequency %d after adding 2 and 1", got)
+	}
+	if !a.Test([]byte("banana")) {
+		t.Fatal("banana from b is missing")
+	}
+
+	// Counts past 255 stop there instead of wrapping round to a small number
+	full := NewCountingBloomFilter(1000, 3)
+	for range 200 {
+		full.Set([]byte("apple"))
+	}
+	if err := full.Add(full); err != nil {
+		t.Fatal(err)
+	}
+	if got := full.Frequency([]byte("apple")); got != maxCount {
+		t.Fatalf("200 + 200 came out as %d", got)
+	}
+	if err := a.Add(NewCountingBloomFilter(500, 3)); !errors.Is(err, ErrIncompatibleFilters) {
+		t.Fatalf("adding a filter of a different size gave %v", err)
+	}
+}
+
+// The same comparison as TestLegacyHasherClusters, boiled down to percentiles. This time the keys are long enough
+// for LegacyHasher to reach past the start of the array, but its sums bunch up around the average key's
+func TestFillPercentiles(t *testing.T) {
+	keys := make([][]byte, 2000)
+	for i := range keys {
+		keys[i] = fmt.Appendf(nil, "%0100d", i)
+	}
+	legacy := NewBloomFilterWithHasher(10_000, 2, LegacyHasher{}).SetAll(keys)
+	fnv := NewBloomFilterWithK(10_000, 2).SetAll(keys)
+
+	p50, p90, p99 := fnv.FillPercentiles(20)
+	if p50 > p90 || p90 > p99 {
+		t.Fatalf("percentiles out of order: %v, %v, %v", p50, p90, p99)
+	}
+	// With FNV the fullest buckets are barely fuller than the median one. With LegacyHasher most buckets are empty
+	legacy50, _, legacy99 := legacy.FillPercentiles(20)
+	if p99 > 2*p50 || legacy99 < 2*legacy50 || legacy99 == 0 {
+		t.Fatalf("FNV's buckets range from %v to %v full, and LegacyHasher's from %v to %v", p50, p99, legacy50, legacy99)
+	}
+
+	// A single bucket is the filter's saturation
+	if p50, p90, p99 := fnv.FillPercentiles(1); p50 != fnv.Saturation() || p90 != p50 || p99 != p50 {
+		t.Fatalf("one bucket gave %v, %v, %v, want the saturation %v", p50, p90, p99, fnv.Saturation())
+	}
+}
+
+func TestArrayIndex(t *testing.T) {
+	scanned := NewArrayWithBloomFilter()
+	indexed := NewArrayWithBloomFilter().EnableIndex()
+	// A small filter that can't grow, so plenty of tests get past it to the scan or the index
+	for _, array := range []*ArrayWithBloomFilter[string]{scanned, indexed} {
+		array.filter = NewBloomFilterWithK(64, 1)
+		array.DisableAutoResize()
+		for _, key := range testKeys("in-", 50) {
+			array.Set(string(key))
+		}
+		array.Set("in-0")
+		array.Remove("in-1")
+		array.Remove("in-0")
+	}
+	for _, key := range append(testKeys("in-", 50), testKeys("out-", 50)...) {
+		if scanned.Test(string(key)) != indexed.Test(string(key)) {
+			t.Fatalf("the index and the scan disagree about %q", key)
+		}
+	}
+	if scanned.Stats() != indexed.Stats() {
+		t.Fatalf("the stats differ: %+v scanned, %+v indexed", scanned.Stats(), indexed.Stats())
+	}
+	if !indexed.Test("in-0") || indexed.Test("in-1") {
+		t.Fatal("the index lost count of duplicates")
+	}
+
+	// Turning the index on later picks up what's already there
+	scanned.EnableIndex()
+	if !scanned.Test("in-0") || scanned.Test("in-1") || scanned.index["in-2"] != 1 {
+		t.Fatal("EnableIndex on a full array didn't index it")
+	}
+}
+
+func TestFold(t *testing.T) {
+	keys := testKeys("key-", 200)
+	filter := NewBloomFilterWithK(8000, 3).SetAll(keys)
+	for times := range 4 {
+		folded, err := filter.Fold(times)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Folding gives exactly the filter we'd have got by adding the keys to a smaller one to start with
+		want := NewBloomFilterWithK(8000>>times, 3).SetAll(keys)
+		if !folded.Equals(want) || folded.InsertCount() != len(keys) {
+			t.Fatalf("folding %d times isn't the same as a filter of size %d", times, 8000>>times)
+		}
+		checkNoFalseNegatives(t, folded, keys)
+	}
+	if _, err := NewBloomFilterWithK(1000, 3).Fold(4); err == nil {
+		t.Fatal("folded 1000 bits four times, though it doesn't divide by 16")
+	}
+	if _, err := filter.Fold(-1); err == nil {
+		t.Fatal("folded -1 times")
+	}
+}
+
+func TestCompareBits(t *testing.T) {
+	a := NewBloomFilterWithK(64, 1)
+	b := NewBloomFilterWithK(64, 1)
+	for _, pos := range []int{1, 2, 3, 10} {
+		a.setBit(pos)
+	}
+	for _, pos := range []int{3, 10, 20} {
+		b.setBit(pos)
+	}
+	onlyA, onlyB, both, err := a.CompareBits(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onlyA != 2 || onlyB != 1 || both != 2 {
+		t.Fatalf("CompareBits gave %d, %d, %d, want 2, 1, 2", onlyA, onlyB, both)
+	}
+
+	disjoint := NewBloomFilterWithK(64, 1)
+	disjoint.setBit(40)
+	if onlyA, onlyB, both, _ := a.CompareBits(disjoint); onlyA != 4 || onlyB != 1 || both != 0 {
+		t.Fatalf("CompareBits of disjoint filters gave %d, %d, %d, want 4, 1, 0", onlyA, onlyB, both)
+	}
+	if onlyA, onlyB, both, _ := a.CompareBits(a.Clone()); onlyA != 0 || onlyB != 0 || both != 4 {
+		t.Fatalf("CompareBits of a copy gave %d, %d, %d, want 0, 0, 4", onlyA, onlyB, both)
+	}
+}
+
+func TestProbablyContains(t *testing.T) {
+	items := testKeys("item-", 100)
+	for _, item := range items {
+		if !ProbablyContains(items, item) {
+			t.Fatalf("%q is one of the items, but ProbablyContains says no", item)
+		}
+	}
+	if rate := positiveRate(probablyContainsOf(items), testKeys("other-", 2000)); rate > 0.03 {
+		t.Fatalf("ProbablyContains says yes to %.1f%% of keys that aren't there", rate*100)
+	}
+	if ProbablyContains(nil, []byte("anything")) {
+		t.Fatal("no items at all can't contain anything")
+	}
+}
+
+// ProbablyContains as something with a Test method, for positiveRate
+type probablyContainsOf [][]byte
+
+func (items probablyContainsOf) Test(query []byte) bool {
+	return ProbablyContains(items, query)
+}
+
+func TestMetrics(t *testing.T) {
+	filter, keys := filledFilter(10_000, 5, 500)
+	metrics := filter.Metrics()
+	want := map[string]float64{
+		"size":            float64(filter.Size()),
+		"set_bits":        float64(filter.PopCount()),
+		"saturation":      filter.Saturation(),
+		"estimated_count": float64(filter.ApproxCount()),
+		"estimated_fpr":   filter.FalsePositiveRate(filter.ApproxCount()),
+	}
+	if !maps.Equal(metrics, want) {
+		t.Fatalf("Metrics is %v, want %v", metrics, want)
+	}
+	if count := metrics["estimated_count"]; count < 0.95*float64(len(keys)) || count > 1.05*float64(len(keys)) {
+		t.Fatalf("estimated_count is %v for %d keys", count, len(keys))
+	}
+	if fpr := metrics["estimated_fpr"]; fpr <= 0 || fpr >= 0.01 {
+		t.Fatalf("estimated_fpr is %v for a filter a fifth full", fpr)
+	}
+
+	var zero BloomFilter
+	for name, value := range zero.Metrics() {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			t.Errorf("%s is %v for a zero-value filter", name, value)
+		}
+	}
+}
+
+func TestFillTo(t *testing.T) {
+	for _, target := range []float64{0, 0.1, 0.5, 0.9} {
+		filter := NewBloomFilterWithK(10_000, 3)
+		added, err := filter.FillTo(target, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Filling stops with the first key that gets there, which sets at most k more bits than it needed
+		if got := filter.Saturation(); got < target || got > target+3.0/10_000 {
+			t.Errorf("FillTo(%v) gave saturation %v", target, got)
+		}
+		if added != filter.InsertCount() {
+			t.Errorf("FillTo(%v) says it added %d keys, but InsertCount is %d", target, added, filter.InsertCount())
+		}
+	}
+
+	// The same seed gives the same filter
+	a, b := NewBloomFilterWithK(10_000, 3), NewBloomFilterWithK(10_000, 3)
+	a.FillTo(0.5, 7)
+	b.FillTo(0.5, 7)
+	if !a.Equals(b) {
+		t.Fatal("FillTo with the same seed gave different filters")
+	}
+
+	// Random 8-byte keys never add up to more than 8*127 with LegacyHasher, so it can't get past the first thousand
+	// or so bits of a big filter
+	legacy := NewBloomFilterWithHasher(100_000, 2, LegacyHasher{})
+	if _, err := legacy.FillTo(0.5, 1); err == nil {
+		t.Fatal("FillTo didn't give up on a filter it can't fill")
+	}
+}
+
+func TestFluentSettings(t *testing.T) {
+	filter := NewBloomFilter().WithSize(5000).WithK(4).WithHasher(SHA256Hasher{}).WithNamespace([]byte("ns")).WithNormalizer(ToLowerNormalizer)
+	if filter.Size() != 5000 || filter.K() != 4 {
+		t.Fatalf("got size %d and k %d", filter.Size(), filter.K())
+	}
+	want := NewBloomFilter(WithSize(5000), WithK(4), WithHasher(SHA256Hasher{}), WithNamespace([]byte("ns")), WithNormalizer(ToLowerNormalizer))
+	if !slices.Equal(filter.getPositions([]byte("Key")), want.getPositions([]byte("Key"))) {
+		t.Fatal("the methods and the options set the filter up differently")
+	}
+
+	filter.Set([]byte("key"))
+	for name, change := range map[string]func(){
+		"WithSize":       func() { filter.WithSize(100) },
+		"WithK":          func() { filter.WithK(2) },
+		"WithHasher":     func() { filter.WithHasher(DefaultHasher{}) },
+		"WithNamespace":  func() { filter.WithNamespace(nil) },
+		"WithNormalizer": func() { filter.WithNormalizer(nil) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s didn't panic on a filter with elements in it", name)
+				}
+			}()
+			change()
+		}()
+	}
+	if filter.Size() != 5000 || !filter.Test([]byte("KEY")) {
+		t.Fatal("a refused change changed the filter anyway")
+	}
+}
+
+func TestMixedHashersRejected(t *testing.T) {
+	filter := NewBloomFilterWithK(1000, 3).Set([]byte("x"))
+	for _, hasher := range []Hasher{LegacyHasher{}, SHA256Hasher{}, SHA256Hasher{Key: []byte("secret")}} {
+		other := NewBloomFilterWithHasher(1000, 3, hasher).Set([]byte("x"))
+		if _, err := filter.Union(other); !errors.Is(err, ErrIncompatibleFilters) {
+			t.Errorf("Union with %T gave %v", hasher, err)
+		}
+		if _, err := filter.Intersect(other); !errors.Is(err, ErrIncompatibleFilters) {
+			t.Errorf("Intersect with %T gave %v", hasher, err)
+		}
+		data, err := other.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := filter.Clone().MergeBytes(data); !errors.Is(err, ErrIncompatibleFilters) {
+			t.Errorf("MergeBytes of data from %T gave %v", hasher, err)
+		}
+	}
+
+	// The same hasher twice is fine, and so is an explicit DefaultHasher alongside the implicit one
+	for _, pair := range [][2]Hasher{{SHA256Hasher{Key: []byte("k")}, SHA256Hasher{Key: []byte("k")}}, {nil, DefaultHasher{}}} {
+		a, b := NewBloomFilterWithHasher(1000, 3, pair[0]), NewBloomFilterWithHasher(1000, 3, pair[1])
+		if _, err := a.Union(b); err != nil {
+			t.Errorf("Union of %T and %T gave %v", pair[0], pair[1], err)
+		}
+	}
+	if _, err := NewBloomFilterWithHasher(1000, 3, SHA256Hasher{Key: []byte("a")}).Union(NewBloomFilterWithHasher(1000, 3, SHA256Hasher{Key: []byte("b")})); !errors.Is(err, ErrIncompatibleFilters) {
+		t.Errorf("Union of SHA256Hashers with different keys gave %v", err)
+	}
+}
+
+// build reads from stdin until it's closed, so feed it through a pipe the way a shell would
+func TestCLIBuild(t *testing.T) {
+	reader, writer := io.Pipe()
+	go func() {
+		for _, key := range testKeys("key-", 500) {
+			fmt.Fprintf(writer, "%s\n\n", key)
+		}
+		writer.Close()
+	}()
+	var stdout, stderr bytes.Buffer
+	if err := runCLI([]string{"-n", "1000", "-fpr", "0.001", "build"}, reader, &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if stderr.Len() != 0 {
+		t.Fatalf("build printed %q", stderr.String())
+	}
+
+	// The output is a filter file, so it loads like one
+	path := filepath.Join(t.TempDir(), "built.bloom")
+	if err := os.WriteFile(path, stdout.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	filter, err := LoadFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, k := OptimalParameters(1000, 0.001)
+	if filter.Size() != m || filter.K() != k || filter.InsertCount() != 500 {
+		t.Fatalf("got size %d, k %d, %d inserts, want %d, %d, 500", filter.Size(), filter.K(), filter.InsertCount(), m, k)
+	}
+	checkNoFalseNegatives(t, filter, testKeys("key-", 500))
+
+	// More keys than it was sized for still works, with a warning
+	stderr.Reset()
+	if err := runCLI([]string{"-n", "10", "build"}, strings.NewReader(strings.Repeat("x\n", 20)), io.Discard, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stderr.String(), "warning: read 20 keys") {
+		t.Fatalf("build printed %q", stderr.String())
+	}
+}
+
+func TestFilterCandidates(t *testing.T) {
+	filter, added := filledFilter(10_000, 5, 100)
+	var candidates [][]byte
+	for i, key := range testKeys("other-", 1000) {
+		candidates = append(candidates, key)
+		if i%10 == 0 {
+			candidates = append(candidates, added[i/10])
+		}
+	}
+	kept := filter.Filter(candidates)
+	// Everything that was added is kept, in order, and most of the rest is dropped
+	var keptAdded [][]byte
+	for _, key := range kept {
+		if slices.ContainsFunc(added, func(a []byte) bool { return bytes.Equal(a, key) }) {
+			keptAdded = append(keptAdded, key)
+		}
+	}
+	if !slices.EqualFunc(keptAdded, added, bytes.Equal) {
+		t.Fatalf("kept %d of the %d added keys", len(keptAdded), len(added))
+	}
+	if len(kept) > len(added)+20 {
+		t.Fatalf("kept %d candidates, only %d of them added", len(kept), len(added))
+	}
+	for _, key := range kept {
+		if !filter.Test(key) {
+			t.Fatalf("kept %q, which tests negative", key)
+		}
+	}
+	if kept := filter.Filter(nil); len(kept) != 0 {
+		t.Fatalf("filtering nothing kept %q", kept)
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	monday, mondayKeys := filledFilter(1000, 3, 50)
+	tuesday := NewBloomFilterWithK(100_000, 5).SetAll(testKeys("tuesday-", 20))
+	filters := map[string]*BloomFilter{"monday": monday, "tuesday": tuesday, "empty": NewBloomFilterWithK(64, 1)}
+
+	var buf bytes.Buffer
+	if err := WriteArchive(&buf, filters); err != nil {
+		t.Fatal(err)
+	}
+	var again bytes.Buffer
+	WriteArchive(&again, filters)
+	if !bytes.Equal(buf.Bytes(), again.Bytes()) {
+		t.Fatal("writing the same filters twice gave different archives")
+	}
+
+	// Anything after the archive is left for the next reader
+	buf.WriteString("more")
+	loaded, err := ReadArchive(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "more" {
+		t.Fatalf("ReadArchive left %q unread", buf.String())
+	}
+	if len(loaded) != len(filters) {
+		t.Fatalf("got %d filters back, want %d", len(loaded), len(filters))
+	}
+	for name, filter := range filters {
+		if !loaded[name].Equals(filter) || loaded[name].InsertCount() != filter.InsertCount() {
+			t.Errorf("%s came back different", name)
+		}
+	}
+	checkSameAnswers(t, monday, loaded["monday"], mondayKeys)
+}
+
+// An archive directory written by hand, for the entries WriteArchive would never write
+func testArchive(data []byte, entries ...archiveEntry) []byte {
+	archive := binary.AppendUvarint(append(bytes.Clone(archiveMagic), archiveVersion), uint64(len(entries)))
+	for _, entry := range entries {
+		archive = binary.AppendUvarint(archive, uint64(len(entry.name)))
+		archive = append(archive, entry.name...)
+		archive = binary.AppendUvarint(archive, entry.offset)
+		archive = binary.AppendUvarint(archive, entry.length)
+	}
+	return append(archive, data...)
+}
+
+func TestReadArchiveBadInput(t *testing.T) {
+	data, err := NewBloomFilterWithK(1000, 3).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := uint64(len(data))
+	good := testArchive(data, archiveEntry{"a", 0, n})
+	if _, err := ReadArchive(bytes.NewReader(good)); err != nil {
+		t.Fatalf("the hand-written archive isn't valid to start with: %v", err)
+	}
+	cases := map[string][]byte{
+		"empty":          nil,
+		"bad magic":      append([]byte("NOPE"), good[4:]...),
+		"bad version":    append(append(bytes.Clone(archiveMagic), 9), good[5:]...),
+		"truncated":      good[:len(good)-1],
+		"short dir":      good[:7],
+		"duplicate name": testArchive(append(data, data...), archiveEntry{"a", 0, n}, archiveEntry{"a", n, n}),
+		"overlap":        testArchive(data, archiveEntry{"a", 0, n}, archiveEntry{"b", 0, n}),
+		"gap":            testArchive(append(data, 0), archiveEntry{"a", 1, n}),
+		"huge length":    testArchive(data, archiveEntry{"a", 0, math.MaxUint64}),
+		"bad filter":     testArchive(data[:n-1], archiveEntry{"a", 0, n - 1}),
+	}
+	for name, bad := range cases {
+		if _, err := ReadArchive(bytes.NewReader(bad)); err == nil {
+			t.Errorf("%s: ReadArchive accepted it", name)
+		}
+	}
+	if err := WriteArchive(io.Discard, map[string]*BloomFilter{"nil": nil}); err == nil {
+		t.Error("WriteArchive accepted a nil filter")
+	}
+}
+
+func TestObservedPositionRange(t *testing.T) {
+	filter := NewBloomFilterWithK(10_000, 3)
+	if lo, hi := filter.ObservedPositionRange(); lo != -1 || hi != -1 {
+		t.Fatalf("before any Set the range is %d to %d", lo, hi)
+	}
+
+	filter.Set([]byte("first"))
+	positions := filter.getPositions([]byte("first"))
+	if lo, hi := filter.ObservedPositionRange(); lo != slices.Min(positions) || hi != slices.Max(positions) {
+		t.Fatalf("after one key the range is %d to %d, but its positions are %v", lo, hi, positions)
+	}
+
+	// The range only ever grows, and with a good hash it soon covers nearly the whole array
+	lastLo, lastHi := filter.ObservedPositionRange()
+	for _, key := range testKeys("key-", 1000) {
+		filter.Set(key)
+		lo, hi := filter.ObservedPositionRange()
+		if lo > lastLo || hi < lastHi {
+			t.Fatalf("the range shrank from %d-%d to %d-%d", lastLo, lastHi, lo, hi)
+		}
+		lastLo, lastHi = lo, hi
+	}
+	if lastLo > 50 || lastHi < 10_000-50 {
+		t.Fatalf("after 1000 keys the range is only %d to %d", lastLo, lastHi)
+	}
+
+	// LegacyHasher never gets far
+	legacy := NewBloomFilterWithHasher(10_000, 2, LegacyHasher{}).SetAll(testKeys("key-", 1000))
+	if _, hi := legacy.ObservedPositionRange(); hi > 1000 {
+		t.Fatalf("LegacyHasher reached position %d with short keys", hi)
+	}
+
+	filter.Reset()
+	if lo, hi := filter.ObservedPositionRange(); lo != -1 || hi != -1 {
+		t.Fatalf("after Reset the range is %d to %d", lo, hi)
+	}
+}
+
+// Run with -race. Every goroutine adds its own keys three times and removes them twice, all at once. The counters
+// are only ever changed atomically, so however the calls interleave, they have to end up exactly where the same
+// calls made one at a time would leave them
+func TestAtomicCountingConcurrentUse(t *testing.T) {
+	const goroutines, perGoroutine = 8, 200
+	concurrent := NewAtomicCountingBloomFilter(10_000, 4)
+	var wg sync.WaitGroup
+	for g := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keys := testKeys(strconv.Itoa(g)+"-", perGoroutine)
+			for range 3 {
+				for _, key := range keys {
+					concurrent.Set(key)
+				}
+			}
+			for range 2 {
+				for _, key := range keys {
+					concurrent.Unset(key)
+					concurrent.Test(key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	sequential := NewAtomicCountingBloomFilter(10_000, 4)
+	for g := range goroutines {
+		for _, key := range testKeys(strconv.Itoa(g)+"-", perGoroutine) {
+			sequential.Set(key)
+		}
+	}
+	if !slices.Equal(concurrent.counts, sequential.counts) {
+		t.Fatal("the counters don't match the same calls made one at a time")
+	}
+	for g := range goroutines {
+		for _, key := range testKeys(strconv.Itoa(g)+"-", perGoroutine) {
+			if concurrent.Frequency(key) < 1 {
+				t.Fatalf("%q was added three times and removed twice, but has frequency %d", key, concurrent.Frequency(key))
+			}
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+// Test returns a bool, which makes it easy to forget that true and false don't mean the same kind of thing: false is
+// a promise, but true is only a "probably". Classify gives the answers names that say exactly that
+type Membership int
+
+const (
+	// The element was never added. A bloom filter can be certain about this
+	DefinitelyNotPresent Membership = iota
+	// The element was probably added, but it might be a false positive
+	ProbablyPresent
+	// The element was certainly added. A bloom filter on its own can never say this, but an ArrayWithBloomFilter
+	// can, because it checks the array
+	DefinitelyPresent
+)
+
+func (m Membership) String() string {
+	switch m {
+	case DefinitelyNotPresent:
+		return "definitely not present"
+	case ProbablyPresent:
+		return "probably present"
+	case DefinitelyPresent:
+		return "definitely present"
+	}
+	return "unknown membership"
+}
+
+// Test, but with an answer that can't be mistaken for a certain yes
+func (f *BloomFilter) Classify(data []byte) Membership {
+	if f.Test(data) {
+		return ProbablyPresent
+	}
+	return DefinitelyNotPresent
+}
+
+// The array always knows for sure: either the filter rules the value out, or we scan the array and find out. So
+// unlike a plain filter, this never says ProbablyPresent
+func (a *ArrayWithBloomFilter[T]) Classify(value T) Membership {
+	if a.Test(value) {
+		return DefinitelyPresent
+	}
+	return DefinitelyNotPresent
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sync"
+)
+
+// A filter has quite a few knobs by now, so rather than a constructor for every combination, NewBloomFilter takes
+// any number of options. Each option is just a function that changes one setting on the new filter before its bit
+// array is allocated. Anything you don't set keeps its default
+type Option func(*BloomFilter)
+
+// Most of the options also come as methods of the same name, which change a filter you've already made and return it,
+// so you can chain them: NewBloomFilter().WithSize(1000).WithK(5). Like the options, they're only for setting a filter
+// up. Changing the size, k or hasher moves every element to different positions, so the bits already set would stop
+// meaning anything. That's why these panic if the filter has anything in it
+func (f *BloomFilter) checkUnused(setting string) {
+	if f.insertCount > 0 || f.PopCount() > 0 {
+		panic("bloom: can't change the " + setting + " of a filter that already has elements in it")
+	}
+}
+
+// See WithSize. This makes a new, empty bit array of the new size
+func (f *BloomFilter) WithSize(size int) *BloomFilter {
+	f.checkUnused("size")
+	if size < 1 {
+		panic("bloom: size must be at least 1")
+	}
+	f.size = size
+	f.bits = make([]uint64, wordsFor(size))
+	if f.instrumented {
+		f.touches = make([]int, size)
+	}
+	return f
+}
+
+// See WithK
+func (f *BloomFilter) WithK(k int) *BloomFilter {
+	f.checkUnused("k")
+	if k < 1 {
+		panic("bloom: k must be at least 1")
+	}
+	f.k = k
+	return f
+}
+
+// See WithHasher
+func (f *BloomFilter) WithHasher(hasher Hasher) *BloomFilter {
+	f.checkUnused("hasher")
+	f.setHasher(hasher)
+	return f
+}
+
+// See WithNormalizer
+func (f *BloomFilter) WithNormalizer(normalize func([]byte) []byte) *BloomFilter {
+	f.checkUnused("normalizer")
+	f.normalize = normalize
+	return f
+}
+
+// The number of bits in the filter. The default is 99
+func WithSize(size int) Option {
+	return func(f *BloomFilter) {
+		f.size = size
+	}
+}
+
+// The number of bits each element sets. The default is 2
+func WithK(k int) Option {
+	return func(f *BloomFilter) {
+		f.k = k
+	}
+}
+
+// The hash function used to pick positions. The default is DefaultHasher
+func WithHasher(hasher Hasher) Option {
+	return func(f *BloomFilter) {
+		f.setHasher(hasher)
+	}
+}
+
+// The seed only remembers what DefaultHasher was given (see NewBloomFilterSeeded), so it has to change along with
+// the hasher. Any other hasher has no seed of ours, so it goes back to 0
+func (f *BloomFilter) setHasher(hasher Hasher) {
+	f.hasher = hasher
+	f.seed = 0
+	if h, ok := hasher.(DefaultHasher); ok {
+		f.seed = h.Seed
+	}
+}
+
+// A namespace stuck on the front of every element before hashing. See the WithNamespace method (in main.go) for why
+// you'd want one
+func WithNamespace(namespace []byte) Option {
+	return func(f *BloomFilter) {
+		f.namespace = append([]byte(nil), namespace...)
+	}
+}
+
+// Run every element through normalize before it's hashed, in Set and Test alike. That way elements that should count
+// as the same, like "ABC" and "abc" with ToLowerNormalizer, land on the same positions. normalize mustn't change
+// the data it's given, only return a new version of it
+//
+// The normalizer is part of what an element means to the filter, like the hasher and the namespace. It isn't saved
+// when the filter is serialized, so give a loaded filter the same one again, and only combine filters that use the
+// same one. Set and Test can't disagree, since the filter applies it to both
+func WithNormalizer(normalize func([]byte) []byte) Option {
+	return func(f *BloomFilter) {
+		f.normalize = normalize
+	}
+}
+
+// Make the filter safe to use from several goroutines at once. See concurrent.go
+func WithConcurrency() Option {
+	return func(f *BloomFilter) {
+		f.mu = &sync.RWMutex{}
+	}
+}
+
+// Keep count of how many Set calls touch each bit, so you can see how the hash is spreading things out with
+// CollisionReport. This stores an int for every bit, which makes the filter dozens of times bigger, so it's only
+// meant for debugging
+func WithInstrumentation() Option {
+	return func(f *BloomFilter) {
+		f.instrumented = true
+	}
+}
+
+// Keep a copy of every key that's added, so that you can find out later exactly what went in with InsertedKeys
+// That's the one thing a bloom filter normally can't tell you, and it's the whole reason a filter is small, so this
+// takes as much memory as all the keys put together. The log is only in memory: it isn't saved with the filter,
+// and it doesn't carry over into the results of Union and friends
+func WithInsertionLog() Option {
+	return func(f *BloomFilter) {
+		f.logInserts = true
+	}
+}
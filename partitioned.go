@@ -0,0 +1,60 @@
+package main
+
+// In a normal bloom filter all k positions for an element can land anywhere, including on top of each other.
+// A partitioned bloom filter splits the bit array into k equal slices instead, and the i-th position for an
+// element always lands in the i-th slice. Every element sets exactly k distinct bits, one per slice, which makes
+// the maths simpler: each slice is really its own little one-hash-function filter
+type PartitionedBloomFilter struct {
+	bits          *BloomFilter // We borrow a normal filter for its packed bit array
+	partitionSize int          // How many bits are in each of the k slices
+	k             int
+}
+
+// If size doesn't divide evenly by k, the few bits left over at the end are never used
+func NewPartitionedBloomFilter(size, k int) *PartitionedBloomFilter {
+	if k < 1 {
+		panic("bloom: k must be at least 1")
+	}
+	if size < k {
+		panic("bloom: size must be at least k, so every partition gets at least one bit")
+	}
+	return &PartitionedBloomFilter{bits: NewBloomFilter(WithSize(size)), partitionSize: size / k, k: k}
+}
+
+func (p *PartitionedBloomFilter) init() {
+	if p.bits == nil {
+		p.bits = NewBloomFilter()
+		p.k = defaultK
+		p.partitionSize = defaultSize / defaultK
+	}
+}
+
+// We hash just like a normal filter, but over a range the size of one slice. Then the i-th position is
+// shifted along into the i-th slice
+func (p *PartitionedBloomFilter) getPositions(data []byte) []int {
+	positions := hashPositions(DefaultHasher{}, data, p.partitionSize, p.k)
+	for i := range positions {
+		positions[i] += i * p.partitionSize
+	}
+	return positions
+}
+
+func (p *PartitionedBloomFilter) Set(data []byte) *PartitionedBloomFilter {
+	p.init()
+	for _, pos := range p.getPositions(data) {
+		p.bits.setBit(pos)
+	}
+	return p
+}
+
+func (p *PartitionedBloomFilter) Test(data []byte) bool {
+	if p.bits == nil {
+		return false
+	}
+	for _, pos := range p.getPositions(data) {
+		if !p.bits.hasBit(pos) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package main
+
+import "time"
+
+// Sometimes "have I ever seen this?" isn't the question, but "have I seen this recently?" is. Think of rate limiting,
+// or ignoring repeats of the same alert within the last ten minutes. A normal filter can't forget, so it would
+// remember everything forever (and fill up doing it)
+//
+// A rotating bloom filter splits time into windows and keeps a filter for each of the last few. New elements go
+// into the current window's filter, and Test checks all of them. When it's time for a new window, the oldest
+// filter is emptied and becomes the current one, so everything that was only added back then is forgotten
+// An element is remembered for at least windows-1 full windows after it was last added, and at most windows
+type RotatingBloomFilter struct {
+	filters  []*BloomFilter // A ring of filters, one per window
+	current  int            // The index in filters of the current window
+	interval time.Duration  // How long each window lasts, or 0 to only rotate when Rotate is called
+	started  time.Time      // When the current window began
+}
+
+// Make a filter that remembers the last windows windows, each one a filter with the given size and k. Pick the
+// size for the number of elements you expect in a single window. Every interval, the oldest window is dropped
+// An interval of 0 turns that off, so windows only change when you call Rotate yourself
+func NewRotatingBloomFilter(windows, size, k int, interval time.Duration) *RotatingBloomFilter {
+	if windows < 1 {
+		panic("bloom: a rotating filter needs at least 1 window")
+	}
+	if interval < 0 {
+		panic("bloom: rotation interval can't be negative")
+	}
+	r := &RotatingBloomFilter{interval: interval, started: time.Now()}
+	for range windows {
+		r.filters = append(r.filters, NewBloomFilterWithK(size, k))
+	}
+	return r
+}
+
+// Start a new window now, forgetting the oldest one. The oldest filter is cleared with Reset, so rotating doesn't
+// allocate anything
+func (r *RotatingBloomFilter) Rotate() {
+	r.current = (r.current + 1) % len(r.filters)
+	r.filters[r.current].Reset()
+	r.started = time.Now()
+}
+
+// Catch up on any rotations that should have happened since the current window began. If nobody has used the filter
+// for longer than all the windows put together, everything in it is out of date, so there's no need to rotate more
+// times than there are windows
+func (r *RotatingBloomFilter) rotateIfDue() {
+	if r.interval == 0 {
+		return
+	}
+	elapsed := time.Since(r.started)
+	for i := 0; i < len(r.filters) && elapsed >= r.interval; i++ {
+		r.Rotate()
+		elapsed -= r.interval
+	}
+	// Keep the windows lined up with the schedule we started on, rather than with whenever we noticed they were due
+	r.started = time.Now().Add(-elapsed % r.interval)
+}
+
+func (r *RotatingBloomFilter) Set(data []byte) *RotatingBloomFilter {
+	r.rotateIfDue()
+	r.filters[r.current].Set(data)
+	return r
+}
+
+// Probably added recently if any of the windows we still remember says so
+func (r *RotatingBloomFilter) Test(data []byte) bool {
+	r.rotateIfDue()
+	for _, filter := range r.filters {
+		if filter.Test(data) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package main
+
+// A normal bloom filter has to be sized up front, and if you add far more elements than you planned for it
+// saturates and stops being useful. A scalable bloom filter gets around this by keeping a list of filters.
+// New elements always go into the newest one, and once that fills up we start another, bigger one.
+// An element might be in any of them, so Test has to check them all
+//
+// Each extra filter adds its own chance of a false positive, so every new filter is built with a tighter
+// false-positive rate than the one before. The rates form a shrinking series (p, p*r, p*r^2, ...) that adds up
+// to p/(1-r), which means the overall false-positive rate stays bounded however many filters we end up with
+//
+// That sum is what the filters are designed for, not what they actually get. The first few filters are small, and
+// small filters do worse than the formulas say: k has to be rounded to a whole number, and double hashing has fewer
+// positions to spread over. Measured, they run up to half as high again as their design rate. So the series only
+// gets half of the rate we were asked for (see scalableHeadroom), which keeps the real rate under it
+type ScalableBloomFilter struct {
+	filters  []*BloomFilter
+	capacity int     // How many elements the newest filter was sized for
+	fpr      float64 // The false-positive rate the newest filter was sized for
+	setBits  int     // How many bits are set in the newest filter, so Set doesn't have to count them every time
+}
+
+const (
+	scalableGrowth     = 2   // Each new filter is sized for this many times as many elements as the last one
+	scalableTightening = 0.8 // Each new filter's false-positive rate is this fraction of the last one's (r above)
+	scalableSaturation = 0.5 // Start a new filter once this fraction of the newest filter's bits are set
+	scalableHeadroom   = 0.5 // The fraction of the overall false-positive rate that the series of filters is sized for
+
+	// What you get with a zero-value ScalableBloomFilter{}
+	defaultScalableCapacity = 100
+	defaultScalableFPR      = 0.01
+)
+
+// initialCapacity is a guess at how many elements you'll add, and falsePositiveRate is the overall rate you want
+// to stay under, no matter how far past that guess you go
+func NewScalableBloomFilter(initialCapacity int, falsePositiveRate float64) *ScalableBloomFilter {
+	if initialCapacity < 1 {
+		panic("bloom: initial capacity must be at least 1")
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		panic("bloom: false-positive rate must be between 0 and 1")
+	}
+	s := &ScalableBloomFilter{}
+	s.addFilter(initialCapacity, firstScalableFPR(falsePositiveRate))
+	return s
+}
+
+func (s *ScalableBloomFilter) init() {
+	if len(s.filters) == 0 {
+		s.addFilter(defaultScalableCapacity, firstScalableFPR(defaultScalableFPR))
+	}
+}
+
+// The first filter gets p*(1-r)*headroom, so that the whole series p*(1-r)*headroom + p*(1-r)*headroom*r + ...
+// adds up to p*headroom, leaving the rest of p to cover how much worse than designed the filters really are
+func firstScalableFPR(p float64) float64 {
+	return p * (1 - scalableTightening) * scalableHeadroom
+}
+
+func (s *ScalableBloomFilter) addFilter(capacity int, fpr float64) {
+	s.filters = append(s.filters, NewBloomFilterFor(capacity, fpr))
+	s.capacity = capacity
+	s.fpr = fpr
+	s.setBits = 0
+}
+
+// New elements always go into the newest filter. A filter sized with OptimalParameters is about half full
+// when it reaches its capacity, so that's when we move on to a new one
+func (s *ScalableBloomFilter) Set(data []byte) *ScalableBloomFilter {
+	s.init()
+	current := s.filters[len(s.filters)-1]
+	if float64(s.setBits)/float64(current.size) >= scalableSaturation {
+		s.addFilter(s.capacity*scalableGrowth, s.fpr*scalableTightening)
+		current = s.filters[len(s.filters)-1]
+	}
+	s.setBits += current.SetCounted(data)
+	return s
+}
+
+// Elements only ever go into one filter, but we don't know which, so an element is probably present if any of
+// the filters says so. Every filter we check is another chance for a false positive, which is why the newer
+// filters need lower false-positive rates
+func (s *ScalableBloomFilter) Test(data []byte) bool {
+	for _, filter := range s.filters {
+		if filter.Test(data) {
+			return true
+		}
+	}
+	return false
+}
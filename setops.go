@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// Every set operation that's handed a filter it can't combine with returns an error wrapping this one, so you can
+// check for it with errors.Is. The message says exactly what didn't match
+var ErrIncompatibleFilters = errors.New("bloom: incompatible filters")
+
+// Two filters can only be combined if every element maps to the same positions in both of them,
+// which means they need the same size, the same number of bits per element, and the same namespace, seed and hasher
+func (f *BloomFilter) checkCompatible(other *BloomFilter) error {
+	f.init()
+	other.init()
+	if f.size != other.size {
+		return fmt.Errorf("%w: different sizes (%d and %d)", ErrIncompatibleFilters, f.size, other.size)
+	}
+	if f.k != other.k {
+		return fmt.Errorf("%w: different k (%d and %d)", ErrIncompatibleFilters, f.k, other.k)
+	}
+	if !bytes.Equal(f.namespace, other.namespace) {
+		return fmt.Errorf("%w: different namespaces (%q and %q)", ErrIncompatibleFilters, f.namespace, other.namespace)
+	}
+	if f.seed != other.seed {
+		return fmt.Errorf("%w: different seeds (%d and %d)", ErrIncompatibleFilters, f.seed, other.seed)
+	}
+	if f.hasherID() != other.hasherID() {
+		return fmt.Errorf("%w: hashers don't match (%T and %T)", ErrIncompatibleFilters, f.hasherOrDefault(), other.hasherOrDefault())
+	}
+	return nil
+}
+
+// An empty filter with the same parameters as f, to hold the result of combining f with another filter
+func (f *BloomFilter) emptyLike() *BloomFilter {
+	return f.emptySized(f.size)
+}
+
+// The same, but with a different size
+func (f *BloomFilter) emptySized(size int) *BloomFilter {
+	result := NewBloomFilterWithHasher(size, f.k, f.hasher)
+	result.namespace = f.namespace
+	result.seed = f.seed
+	result.normalize = f.normalize
+	return result
+}
+
+// The union of two filters is a filter that contains everything either of them contains. Since adding an
+// element just sets some bits, a bit is set in the union if it's set in either filter: we just OR them together
+// Neither input is changed
+func (f *BloomFilter) Union(other *BloomFilter) (*BloomFilter, error) {
+	if err := f.checkCompatible(other); err != nil {
+		return nil, err
+	}
+	result := f.emptyLike()
+	// Because the bits are packed into words, we can OR 64 of them at a time
+	for i := range result.bits {
+		result.bits[i] = f.bits[i] | other.bits[i]
+	}
+	// Every Set call on either filter is now part of the union
+	result.insertCount = f.insertCount + other.insertCount
+	return result, nil
+}
+
+// Combining lots of filters with Union one pair at a time makes a new filter for every step along the way. UnionAll
+// checks that all of them are compatible first, and only then makes a single result and ORs every filter into it
+// There's nothing sensible to return for no filters at all (we wouldn't know what size to make it), so that's an error
+func UnionAll(filters ...*BloomFilter) (*BloomFilter, error) {
+	if len(filters) == 0 {
+		return nil, errors.New("bloom: UnionAll needs at least one filter")
+	}
+	first := filters[0]
+	for _, other := range filters[1:] {
+		if err := first.checkCompatible(other); err != nil {
+			return nil, err
+		}
+	}
+	first.init()
+	result := first.emptyLike()
+	for _, filter := range filters {
+		for i, word := range filter.bits {
+			result.bits[i] |= word
+		}
+		result.insertCount += filter.insertCount
+	}
+	return result, nil
+}
+
+// How many distinct elements are in all of the filters put together, without actually making their union. Counting
+// the bits set in the union only needs one word of it at a time, so we OR each word from every filter and count that,
+// then use the same estimate as ApproxCount. Elements that were added to more than one filter only count once
+// Like the other set operations, this only works for compatible filters, and panics if they aren't. No filters at
+// all have no elements, so that's 0
+func EstimateUnionCardinality(filters ...*BloomFilter) int {
+	if len(filters) == 0 {
+		return 0
+	}
+	first := filters[0]
+	first.init()
+	for _, other := range filters[1:] {
+		if err := first.checkCompatible(other); err != nil {
+			panic(err)
+		}
+	}
+	set := 0
+	for i := range first.bits {
+		var word uint64
+		for _, filter := range filters {
+			word |= filter.bits[i]
+		}
+		set += bits.OnesCount64(word)
+	}
+	return estimateCount(set, first.size, first.k)
+}
+
+// The intersection ANDs the two bit arrays together, keeping only the bits set in both filters.
+// Unlike the union, this is lossy. An element that was only added to one filter can still test positive
+// in the intersection, if the other filter happens to have its bits set by other elements. So a positive
+// here doesn't mean the element was in both sets, and the false-positive rate can be higher than you'd get
+// by building a filter from the real intersection of the two sets. What you do still get is no false
+// negatives: anything that really was added to both filters will test positive
+func (f *BloomFilter) Intersect(other *BloomFilter) (*BloomFilter, error) {
+	if err := f.checkCompatible(other); err != nil {
+		return nil, err
+	}
+	result := f.emptyLike()
+	for i := range result.bits {
+		result.bits[i] = f.bits[i] & other.bits[i]
+	}
+	return result, nil
+}
+
+// The difference keeps the bits that are set in f but not in baseline. If baseline is an old snapshot of f, that's
+// every bit that's been set since the snapshot was taken. Note that this is about bits, not elements: an element
+// added since the snapshot only shows up here if at least one of its bits was still 0 in the snapshot, and the
+// result shouldn't be Tested for elements directly, because an element whose bits were partly set already will
+// test negative in it
+// Like Union and Intersect, this needs the filters to have the same size and k
+func (f *BloomFilter) Difference(baseline *BloomFilter) (*BloomFilter, error) {
+	if err := f.checkCompatible(baseline); err != nil {
+		return nil, err
+	}
+	result := f.emptyLike()
+	for i := range result.bits {
+		result.bits[i] = f.bits[i] &^ baseline.bits[i]
+	}
+	return result, nil
+}
+
+// Two filters are equal if they have the same parameters and exactly the same bits set. Equal filters
+// give the same answer for every Test, whatever elements were used to build them
+func (f *BloomFilter) Equals(other *BloomFilter) bool {
+	if other == nil {
+		return false
+	}
+	if f.checkCompatible(other) != nil {
+		return false
+	}
+	for i := range f.bits {
+		if f.bits[i] != other.bits[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// How alike are the sets behind two filters? For real sets, the Jaccard similarity is the size of the
+// intersection divided by the size of the union: 1 for identical sets, 0 for sets with nothing in common.
+// We can't see the sets, so we do the same thing with bits instead: bits set in both filters divided by bits set
+// in either. This is only an estimate, and it's biased upwards: unrelated elements sometimes share bits, so two
+// filters of completely different elements still score above 0, and more so the fuller the filters are
+// Filters with different sizes or k can't be compared at all, so they get 0. Two empty filters are identical, so they get 1
+func (f *BloomFilter) Similarity(other *BloomFilter) float64 {
+	if f.checkCompatible(other) != nil {
+		return 0
+	}
+	both, either := 0, 0
+	for i := range f.bits {
+		both += bits.OnesCount64(f.bits[i] & other.bits[i])
+		either += bits.OnesCount64(f.bits[i] | other.bits[i])
+	}
+	if either == 0 {
+		return 1
+	}
+	return float64(both) / float64(either)
+}
+
+// Similarity sums up how alike two filters are in one number. CompareBits gives the three counts behind it: bits set
+// only in f, bits set only in other, and bits set in both. If one filter is meant to be a copy of the other (say,
+// one is built and the other is what got shipped to a server), anything but zeros in the first two means they've
+// drifted apart, and the counts tell you which side has what the other is missing
+func (f *BloomFilter) CompareBits(other *BloomFilter) (onlyInF, onlyInOther, inBoth int, err error) {
+	if err := f.checkCompatible(other); err != nil {
+		return 0, 0, 0, err
+	}
+	for i := range f.bits {
+		onlyInF += bits.OnesCount64(f.bits[i] &^ other.bits[i])
+		onlyInOther += bits.OnesCount64(other.bits[i] &^ f.bits[i])
+		inBoth += bits.OnesCount64(f.bits[i] & other.bits[i])
+	}
+	return onlyInF, onlyInOther, inBoth, nil
+}
+
+// Every position comes from taking a hash modulo the size, and when the size is even, (h mod m) mod m/2 is the same
+// as h mod m/2. So a filter of size m folds neatly into one of size m/2: bit i of the small filter is just bit i
+// OR bit i+m/2 of the big one, and every element lands on exactly the positions it would have if it had been added
+// to a filter of size m/2 all along. Fold does that times times over, halving the size each time, which is handy
+// for shrinking a filter before sending it somewhere. Everything that tested positive still does, but the smaller
+// filter is fuller, so it has more false positives
+// The size has to divide evenly by 2^times. Folding 0 times just gives you a copy
+func (f *BloomFilter) Fold(times int) (*BloomFilter, error) {
+	f.init()
+	if times < 0 || times >= 63 {
+		return nil, fmt.Errorf("bloom: can't fold a filter %d times", times)
+	}
+	if f.size%(1<<times) != 0 {
+		return nil, fmt.Errorf("bloom: can't fold a filter of size %d %d times, since it doesn't divide by %d", f.size, times, 1<<times)
+	}
+	size := f.size >> times
+	result := f.emptySized(size)
+	f.EachSetBit(func(index int) {
+		result.setBit(index % size)
+	})
+	result.insertCount = f.insertCount
+	return result, nil
+}
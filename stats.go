@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Counting how many bits are set to 1 is the starting point for most of the things we can work out about a filter.
+// This is called a "population count", and since the bits are packed into words we don't need to look at them one
+// at a time: OnesCount64 counts all 64 bits of a word at once, usually with a single CPU instruction
+func (f *BloomFilter) PopCount() int {
+	f.rlock()
+	defer f.runlock()
+	return f.popCount()
+}
+
+// PopCount for callers that already hold the lock (or don't need it), since taking the read lock twice can deadlock
+func (f *BloomFilter) popCount() int {
+	count := 0
+	for _, word := range f.bits {
+		count += bits.OnesCount64(word)
+	}
+	return count
+}
+
+// A bloom filter doesn't remember what was added to it, but we can still guess how many distinct elements
+// went in by looking at how full it is. If m is the size, k the number of bits per element and X the number
+// of bits that are set, the standard estimate is:
+//
+//	n ≈ -(m/k) * ln(1 - X/m)
+//
+// Adding the same element twice doesn't set any new bits, so this counts distinct elements
+func (f *BloomFilter) ApproxCount() int {
+	f.rlock()
+	defer f.runlock()
+	return estimateCount(f.popCount(), f.size, f.k)
+}
+
+// The formula behind ApproxCount, for set bits out of size with k bits per element
+func estimateCount(set, size, k int) int {
+	if set == 0 {
+		return 0
+	}
+	m := float64(size)
+	x := float64(set)
+	if set == size {
+		// Once every bit is set the formula takes the log of 0 and blows up to infinity. All we really know
+		// is that a lot of elements went in, so pretend one bit is still free and report that (finite) estimate
+		x = m - 1
+	}
+	return int(math.Round(-(m / float64(k)) * math.Log(1-x/m)))
+}
+
+// If a filter of m bits with k bits per element has had n elements added, the chance that some other element
+// tests positive anyway is roughly:
+//
+//	(1 - e^(-kn/m))^k
+//
+// The e^(-kn/m) part is the chance that any one bit is still 0, so the whole thing is the chance that all k
+// bits for a new element happen to be 1 already
+func (f *BloomFilter) FalsePositiveRate(n int) float64 {
+	f.rlock()
+	defer f.runlock()
+	f.init()
+	return falsePositiveRate(f.size, n, f.k)
+}
+
+func falsePositiveRate(m, n, k int) float64 {
+	return math.Pow(1-math.Exp(-float64(k)*float64(n)/float64(m)), float64(k))
+}
+
+// Picking k is a balancing act: each extra bit per element makes a false positive need one more coincidence, but
+// also fills the filter up faster. This works out the false-positive rate for every k from 1 to maxK, for a filter
+// of m bits holding n elements, so you can see the tradeoff for yourself and pick the k with the smallest rate.
+// It's always near (m/n) * ln 2, the k that OptimalParameters picks
+// This panics if m, n or maxK is less than 1
+func FalsePositiveTable(m, n, maxK int) map[int]float64 {
+	if m < 1 || n < 1 || maxK < 1 {
+		panic("bloom: m, n and maxK must all be at least 1")
+	}
+	table := make(map[int]float64, maxK)
+	for k := 1; k <= maxK; k++ {
+		table[k] = falsePositiveRate(m, n, k)
+	}
+	return table
+}
+
+// Working backwards from the false-positive formula tells us how to size a filter. For n elements and a target
+// false-positive probability p, the best number of bits and bits per element are:
+//
+//	m = -n * ln(p) / (ln 2)^2
+//	k = (m/n) * ln 2
+//
+// For example, a million elements at a 1% false-positive rate needs about 9.6 million bits (1.2MB) and k = 7
+func OptimalParameters(n int, p float64) (m, k int) {
+	if n < 1 {
+		panic("bloom: n must be at least 1")
+	}
+	if p <= 0 || p >= 1 {
+		panic("bloom: false-positive probability must be between 0 and 1")
+	}
+	m = int(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k = int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return m, k
+}
+
+// The best k for a filter depends on how many elements it holds: k = (m/n) * ln 2, the same formula OptimalParameters
+// uses. A filter sized for a thousand elements that has ended up holding ten thousand would do better with a much
+// smaller k (and even better with more bits). RecommendedK works that out from ApproxCount, so you can tell when
+// it's worth rebuilding the filter with a different k. It only looks, and never changes the filter
+// An empty filter gives us nothing to go on, so it gets its current k back
+func (f *BloomFilter) RecommendedK() int {
+	f.rlock()
+	defer f.runlock()
+	n := estimateCount(f.popCount(), f.size, f.k)
+	if n == 0 {
+		return f.K()
+	}
+	k := int(math.Round(float64(f.size) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return k
+}
+
+// How many bits the filter is spending on each element it holds, m / n, using ApproxCount for n. This is the number
+// to compare when you're tuning: a filter at its best false-positive rate of p needs about 1.44 * log2(1/p) bits
+// per element, so 1% needs about 9.6, and 0.1% about 14.4. An empty filter is spending its bits on nothing, which
+// comes out as +Inf rather than a division by zero
+func (f *BloomFilter) BitsPerElement() float64 {
+	f.rlock()
+	defer f.runlock()
+	n := estimateCount(f.popCount(), f.size, f.k)
+	if n == 0 {
+		return math.Inf(1)
+	}
+	return float64(f.size) / float64(n)
+}
+
+// Roughly how much memory the filter takes up, in bytes. Nearly all of it is the bit array, and since we pack 64 bits
+// into every word (see wordsFor), that's one byte for every 8 bits. A million-bit filter needs about 125KB, where a
+// []bool would have needed a whole 1MB. A filter made with WithInstrumentation also counts its per-position counters,
+// which are far bigger than the bits themselves. The few fields in the struct itself are left out
+func (f *BloomFilter) MemoryBytes() int {
+	f.rlock()
+	defer f.runlock()
+	return len(f.bits)*8 + len(f.touches)*strconv.IntSize/8
+}
+
+// As more elements go in, more bits get set, until eventually nearly every bit is 1 and nearly everything tests
+// positive. Saturation is the fraction of bits that are set, from 0 (empty) to 1 (useless)
+func (f *BloomFilter) Saturation() float64 {
+	f.rlock()
+	defer f.runlock()
+	return f.saturation()
+}
+
+func (f *BloomFilter) saturation() float64 {
+	if f.size == 0 {
+		return 0
+	}
+	return float64(f.popCount()) / float64(f.size)
+}
+
+// A handy check for "time to rebuild this filter bigger". A well-sized filter sits at around 0.5 saturation,
+// and the false-positive rate climbs steeply above that
+func (f *BloomFilter) IsSaturated(threshold float64) bool {
+	return f.Saturation() >= threshold
+}
+
+// Printing the raw struct just shows a list of big numbers, which isn't much help. String sums up the things
+// you actually care about, and for small filters it also draws the bits themselves, like this:
+//
+//	BloomFilter{size: 16, k: 2, set bits: 4, saturation: 25.0%, estimated count: 2, bits: 0001000000011100}
+func (f *BloomFilter) String() string {
+	f.rlock()
+	defer f.runlock()
+	var b strings.Builder
+	// A zero-value filter has no bits yet, so it's summed up as the empty filter of the default size it will become
+	size, k, set := f.Size(), f.K(), f.popCount()
+	fmt.Fprintf(&b, "BloomFilter{size: %d, k: %d, set bits: %d, saturation: %.1f%%, estimated count: %d",
+		size, k, set, float64(set)/float64(size)*100, estimateCount(set, size, k))
+	if size < 128 {
+		b.WriteString(", bits: ")
+		for pos := 0; pos < size; pos++ {
+			if f.bits != nil && f.hasBit(pos) {
+				b.WriteByte('1')
+			} else {
+				b.WriteByte('0')
+			}
+		}
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// Call fn with the index of every bit that's set, from lowest to highest. Rather than checking bits one at a time,
+// we skip straight from one set bit to the next: TrailingZeros64 tells us how far along a word the lowest set bit
+// is, and word &= word-1 clears that bit so the next call finds the one after it
+// fn is called with the read lock held (see concurrent.go), so it mustn't change the filter
+func (f *BloomFilter) EachSetBit(fn func(index int)) {
+	f.rlock()
+	defer f.runlock()
+	f.eachSetBit(fn)
+}
+
+func (f *BloomFilter) eachSetBit(fn func(index int)) {
+	for i, word := range f.bits {
+		for word != 0 {
+			fn(i*64 + bits.TrailingZeros64(word))
+			word &= word - 1
+		}
+	}
+}
+
+// The indices of every bit that's set, in increasing order. Looking at these is a good way to see whether the
+// hash is spreading elements out nicely. For a big, full filter this can be a very long list, in which case
+// EachSetBit avoids building it
+func (f *BloomFilter) SetBits() []int {
+	indices := make([]int, 0)
+	f.EachSetBit(func(index int) {
+		indices = append(indices, index)
+	})
+	return indices
+}
+
+// Split the bit array into equal regions and count the set bits in each. With a good hash, every region should fill
+// up at about the same rate, so the counts come out roughly equal. If a few regions have far more than the rest, the
+// hash is clustering elements together, and those regions will saturate (and cause false positives) early
+// When the size doesn't divide evenly, the regions differ in size by at most one bit
+func (f *BloomFilter) DensityHistogram(buckets int) []int {
+	if buckets < 1 {
+		panic("bloom: need at least one bucket")
+	}
+	f.rlock()
+	defer f.runlock()
+	return f.densityHistogram(buckets)
+}
+
+func (f *BloomFilter) densityHistogram(buckets int) []int {
+	histogram := make([]int, buckets)
+	f.eachSetBit(func(index int) {
+		histogram[index*buckets/f.size]++
+	})
+	return histogram
+}
+
+// A histogram with hundreds of buckets is a lot to look at. FillPercentiles boils it down to three numbers: the
+// fraction of bits set in the median bucket, and in the buckets 90% and 99% of the way up from the emptiest. With a
+// good hash all three are close together, since every bucket fills at about the same rate. If p99 is far above
+// p50, a few buckets are filling much faster than the rest, which is a sign the hash is clustering and worth replacing
+// If there are more buckets than bits, the buckets with no bits in them are left out
+func (f *BloomFilter) FillPercentiles(buckets int) (p50, p90, p99 float64) {
+	if buckets < 1 {
+		panic("bloom: need at least one bucket")
+	}
+	f.rlock()
+	defer f.runlock()
+	f.init()
+	histogram := f.densityHistogram(buckets)
+	fills := make([]float64, 0, buckets)
+	for i, count := range histogram {
+		// Bucket i holds the bits whose index*buckets/size comes out as i, which is this many of them
+		start := (i*f.size + buckets - 1) / buckets
+		end := ((i+1)*f.size + buckets - 1) / buckets
+		if end > start {
+			fills = append(fills, float64(count)/float64(end-start))
+		}
+	}
+	slices.Sort(fills)
+	// The p-th percentile is the smallest fill that at least p of the buckets are no fuller than
+	percentile := func(p float64) float64 {
+		return fills[max(int(math.Ceil(p*float64(len(fills))))-1, 0)]
+	}
+	return percentile(0.5), percentile(0.9), percentile(0.99)
+}
+
+// All the numbers worth keeping an eye on for a filter in production, in one map, ready to hand to a metrics system
+// like Prometheus. The names follow the usual metric naming style:
+//
+//	size             the number of bits (Size)
+//	set_bits         how many of them are set (PopCount)
+//	saturation       the fraction that are set, from 0 to 1 (Saturation)
+//	estimated_count  a guess at how many distinct elements went in (ApproxCount)
+//	estimated_fpr    the false-positive rate you can expect right now, for that many elements (FalsePositiveRate)
+//
+// The one to alert on is usually saturation or estimated_fpr creeping up, since that means it's time for a bigger filter
+func (f *BloomFilter) Metrics() map[string]float64 {
+	f.rlock()
+	defer f.runlock()
+	f.init()
+	set := f.popCount()
+	count := estimateCount(set, f.size, f.k)
+	return map[string]float64{
+		"size":            float64(f.size),
+		"set_bits":        float64(set),
+		"saturation":      float64(set) / float64(f.size),
+		"estimated_count": float64(count),
+		"estimated_fpr":   falsePositiveRate(f.size, count, f.k),
+	}
+}